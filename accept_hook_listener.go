@@ -0,0 +1,110 @@
+package graceful
+
+import (
+	"net"
+	"sync"
+)
+
+// acceptHookListener passes each accepted connection through the OnAccept
+// callback of srv, dropping the ones it rejects. The callback runs in a
+// goroutine of its own for each connection, so that one that takes long,
+// such as one waiting for a PROXY protocol header, does not hold up
+// accepting the others.
+type acceptHookListener struct {
+	net.Listener
+	srv *Server
+
+	accepted  chan acceptResult
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newAcceptHookListener(l net.Listener, srv *Server) *acceptHookListener {
+	ln := &acceptHookListener{
+		Listener: l,
+		srv:      srv,
+		accepted: make(chan acceptResult),
+		done:     make(chan struct{}),
+	}
+	go ln.acceptLoop()
+	return ln
+}
+
+func (ln *acceptHookListener) Accept() (net.Conn, error) {
+	select {
+	case res := <-ln.accepted:
+		return res.conn, res.err
+	case <-ln.done:
+		return nil, errListenerClosed
+	}
+}
+
+func (ln *acceptHookListener) Close() error {
+	ln.closeOnce.Do(func() { close(ln.done) })
+	return ln.Listener.Close()
+}
+
+// acceptLoop accepts connections until the listener fails, and hooks each
+// one in a goroutine of its own. Errors are passed on to Accept.
+func (ln *acceptHookListener) acceptLoop() {
+	for {
+		c, err := ln.Listener.Accept()
+		if err == nil {
+			go ln.deliver(c)
+			continue
+		}
+		select {
+		case ln.accepted <- acceptResult{nil, err}:
+		case <-ln.done:
+			return
+		}
+		if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+			return
+		}
+	}
+}
+
+// deliver hooks c and hands the connection to serve to Accept, or closes
+// it if the listener is closed first.
+func (ln *acceptHookListener) deliver(c net.Conn) {
+	hooked := ln.hook(c)
+	if hooked == nil {
+		return
+	}
+	select {
+	case ln.accepted <- acceptResult{hooked, nil}:
+	case <-ln.done:
+		hooked.Close()
+	}
+}
+
+// hook calls OnAccept for c, and returns the connection to serve, or nil
+// if c was rejected and closed.
+func (ln *acceptHookListener) hook(c net.Conn) (hooked net.Conn) {
+	defer func() {
+		if r := recover(); r != nil {
+			ln.srv.logf("[ERROR] OnAccept panic: %v", r)
+			c.Close()
+			hooked = nil
+		}
+	}()
+
+	hooked, err := ln.srv.OnAccept(c)
+	if err != nil || hooked == nil {
+		if err != nil {
+			ln.srv.logf("rejected connection from %s: %s", rawRemoteAddr(c), err)
+		}
+		c.Close()
+		return nil
+	}
+	return hooked
+}
+
+// rawRemoteAddr returns the address of the peer of c, without waiting for
+// the PROXY protocol header of a proxyConn.
+func rawRemoteAddr(c net.Conn) net.Addr {
+	if pc, ok := c.(*proxyConn); ok {
+		return pc.Conn.RemoteAddr()
+	}
+	return c.RemoteAddr()
+}
@@ -0,0 +1,100 @@
+package graceful
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+type taggedConn struct {
+	net.Conn
+	tag string
+}
+
+func TestOnAccept(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	reject := false
+	tags := make(chan string, 10)
+	srv := &Server{Timeout: killTime, Server: server, NoSignalHandling: true,
+		OnAccept: func(conn net.Conn) (net.Conn, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if reject {
+				return nil, errors.New("rejected")
+			}
+			return &taggedConn{conn, "tenant"}, nil
+		},
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			if tc, ok := conn.(*taggedConn); ok && state == http.StateNew {
+				tags <- tc.tag
+			}
+		}}
+	go srv.Serve(l)
+	defer srv.StopWithResult(killTime)
+	time.Sleep(waitTime)
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	r, err := client.Get(fmt.Sprintf("http://localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if tag := <-tags; tag != "tenant" {
+		t.Fatalf("expected the wrapped connection to be served, got tag %q", tag)
+	}
+
+	mu.Lock()
+	reject = true
+	mu.Unlock()
+	if _, err := client.Get(fmt.Sprintf("http://localhost:%d", port)); err == nil {
+		t.Fatal("expected the rejected connection to be closed")
+	}
+}
+
+func TestOnAcceptSlowProxyHeader(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Timeout: killTime, Server: server, NoSignalHandling: true, ProxyProtocol: true,
+		OnAccept: func(conn net.Conn) (net.Conn, error) {
+			// waits for the PROXY header
+			conn.RemoteAddr()
+			return conn, nil
+		}}
+	go srv.Serve(l)
+	defer srv.StopWithResult(killTime)
+	time.Sleep(waitTime)
+
+	// A client that never sends its PROXY header...
+	silent, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	time.Sleep(waitTime)
+
+	// ...does not hold up the next one.
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeoutTime))
+	fmt.Fprint(conn, "PROXY TCP4 192.0.2.1 192.0.2.2 1234 80\r\nGET / HTTP/1.0\r\n\r\n")
+	r, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("expected the second client to be served, got %s", err)
+	}
+	r.Body.Close()
+}
@@ -0,0 +1,58 @@
+package graceful
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// backoffListener retries temporary Accept errors, such as running out of
+// file descriptors, after a delay that starts at 5ms and doubles up to max,
+// so that the accept loop does not spin. Closing the listener interrupts
+// the delay, so that shutdown is not held up.
+type backoffListener struct {
+	net.Listener
+	max  time.Duration
+	logf func(format string, args ...interface{})
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newBackoffListener(l net.Listener, max time.Duration, logf func(string, ...interface{})) *backoffListener {
+	if max <= 0 {
+		max = time.Second
+	}
+	return &backoffListener{Listener: l, max: max, logf: logf, done: make(chan struct{})}
+}
+
+func (ln *backoffListener) Accept() (net.Conn, error) {
+	var delay time.Duration
+	for {
+		c, err := ln.Listener.Accept()
+		if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+			return c, err
+		}
+
+		if delay == 0 {
+			delay = 5 * time.Millisecond
+		} else {
+			delay *= 2
+		}
+		if delay > ln.max {
+			delay = ln.max
+		}
+		ln.logf("accept error: %s; retrying in %s", err, delay)
+
+		select {
+		case <-time.After(delay):
+		case <-ln.done:
+			return nil, errListenerClosed
+		}
+	}
+}
+
+func (ln *backoffListener) Close() error {
+	ln.closeOnce.Do(func() { close(ln.done) })
+	return ln.Listener.Close()
+}
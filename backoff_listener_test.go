@@ -0,0 +1,86 @@
+package graceful
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+type temporaryError struct{ error }
+
+func (e temporaryError) Temporary() bool { return true }
+func (e temporaryError) Timeout() bool   { return false }
+
+// failingListener fails to accept with a temporary error until fails
+// runs out, and then accepts conn.
+type failingListener struct {
+	net.Listener
+	fails int
+	conn  net.Conn
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	if l.fails > 0 {
+		l.fails--
+		return nil, temporaryError{errors.New("too many open files")}
+	}
+	return l.conn, nil
+}
+
+func (l *failingListener) Close() error { return nil }
+
+func TestBackoffListener(t *testing.T) {
+	conn, client := net.Pipe()
+	defer conn.Close()
+	defer client.Close()
+
+	ln := newBackoffListener(&failingListener{fails: 3, conn: conn}, 0, t.Logf)
+	start := time.Now()
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != conn {
+		t.Fatal("expected the connection accepted after the errors")
+	}
+	if elapsed := time.Since(start); elapsed < 35*time.Millisecond {
+		t.Fatalf("expected to back off for 5ms, 10ms and 20ms, took %s", elapsed)
+	}
+}
+
+func TestBackoffListenerMax(t *testing.T) {
+	conn, client := net.Pipe()
+	defer conn.Close()
+	defer client.Close()
+
+	ln := newBackoffListener(&failingListener{fails: 5, conn: conn}, 10*time.Millisecond, t.Logf)
+	start := time.Now()
+	if _, err := ln.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > waitTime {
+		t.Fatalf("expected the delay to be capped at 10ms, took %s", elapsed)
+	}
+}
+
+func TestBackoffListenerClose(t *testing.T) {
+	ln := newBackoffListener(&failingListener{fails: 1 << 30}, time.Hour, t.Logf)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := ln.Accept()
+		errc <- err
+	}()
+	time.Sleep(waitTime)
+	ln.Close()
+
+	select {
+	case err := <-errc:
+		if err != errListenerClosed {
+			t.Fatalf("expected %v, got %v", errListenerClosed, err)
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("Close should interrupt the backoff")
+	}
+}
@@ -0,0 +1,29 @@
+package graceful
+
+import "time"
+
+// Clock tells the time for the shutdown of a Server: the GraceWindow, the
+// SoftTimeout, the timeout and the durations in ShutdownStats. Tests can
+// set Server.Clock to a fake one to control them without sleeping.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After returns a channel on which the time is sent once d has
+	// elapsed, like time.After.
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the Clock used when Server.Clock is nil.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// clock returns the Clock of the server.
+func (srv *Server) clock() Clock {
+	if srv.Clock != nil {
+		return srv.Clock
+	}
+	return realClock{}
+}
@@ -0,0 +1,110 @@
+package graceful
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock whose time only moves when Advance is called.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w := fakeWaiter{at: c.now.Add(d), c: make(chan time.Time, 1)}
+	c.waiters = append(c.waiters, w)
+	return w.c
+}
+
+// Advance moves the time forward by d, firing the waiters that are due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	waiting := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiting = append(waiting, w)
+		} else {
+			w.c <- c.now
+		}
+	}
+	c.waiters = waiting
+}
+
+// waitFor blocks until a waiter is due at d from now.
+func (c *fakeClock) waitFor(t *testing.T, d time.Duration) {
+	deadline := time.Now().Add(timeoutTime)
+	for time.Now().Before(deadline) {
+		c.mu.Lock()
+		for _, w := range c.waiters {
+			if w.at.Sub(c.now) == d {
+				c.mu.Unlock()
+				return
+			}
+		}
+		c.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("nothing waited for %s", d)
+}
+
+func TestClockShutdownPhases(t *testing.T) {
+	server, l, err := createListener(10 * timeoutTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := newFakeClock()
+	statsc := make(chan ShutdownStats, 1)
+	srv := &Server{Server: server, NoSignalHandling: true, Clock: clock,
+		Timeout: time.Hour, GraceWindow: time.Minute,
+		OnShutdownComplete: func(stats ShutdownStats) { statsc <- stats }}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	wg.Add(1)
+	go runQuery(t, http.StatusOK, true, &wg, &once)
+	time.Sleep(waitTime)
+
+	srv.Stop(time.Hour)
+	clock.waitFor(t, time.Minute)
+	clock.Advance(time.Minute)
+	clock.waitFor(t, time.Hour)
+	clock.Advance(time.Hour)
+
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("the server should stop once the fake timeout has expired")
+	}
+	wg.Wait()
+
+	stats := <-statsc
+	if stats.InitiateDuration != time.Minute || stats.DrainDuration != time.Hour || stats.ForcedConnections != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,59 @@
+package graceful
+
+import (
+	"net/http"
+	"reflect"
+)
+
+// Clone returns a new server with the configuration of srv, so that one
+// configured server can be used as a template for several listeners, each
+// served by a clone of its own. The exported fields are copied, along with
+// those of the embedded http.Server, which the clone gets a copy of.
+// Values such as the Logger, the hooks and the TLSConfig are shared rather
+// than copied.
+//
+// None of the runtime state is copied: the clone is not running, has
+// fresh channels and counters, and Interrupted is false. Its ConnTracker is
+// nil, since a tracker holds the connections of a single server, and it
+// serves the handler set by SetHandler, if any.
+//
+// Clone srv before it is served: once it has started, net/http fills in
+// fields of the http.Server, such as TLSNextProto, which would then be
+// shared with the clone.
+func (srv *Server) Clone() *Server {
+	clone := &Server{}
+	copyExported(reflect.ValueOf(clone).Elem(), reflect.ValueOf(srv).Elem(), "Server", "ConnTracker", "Interrupted")
+	if srv.Server == nil {
+		return clone
+	}
+
+	clone.Server = &http.Server{}
+	copyExported(reflect.ValueOf(clone.Server).Elem(), reflect.ValueOf(srv.Server).Elem(), "Handler")
+	srv.handlerLock.RLock()
+	clone.Handler = srv.handler
+	srv.handlerLock.RUnlock()
+	if clone.Handler == nil {
+		clone.Handler = srv.Server.Handler
+	}
+	return clone
+}
+
+// copyExported copies the exported fields of the struct src to dst, which
+// has the same type, except for those named in skip. Unexported fields,
+// such as locks, are left as they are.
+func copyExported(dst, src reflect.Value, skip ...string) {
+	t := src.Type()
+fields:
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		for _, name := range skip {
+			if f.Name == name {
+				continue fields
+			}
+		}
+		dst.Field(i).Set(src.Field(i))
+	}
+}
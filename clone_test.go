@@ -0,0 +1,68 @@
+package graceful
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestClone(t *testing.T) {
+	listened := make(chan net.Addr, 2)
+	template := &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		ConnTracker:      newConnTracker(),
+		OnListen:         func(addr net.Addr) { listened <- addr },
+		Server: &http.Server{
+			Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(rw, "hello")
+			}),
+			MaxHeaderBytes: 4096,
+		},
+	}
+
+	var clones []*Server
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		srv := template.Clone()
+		if srv.Server == template.Server || srv.MaxHeaderBytes != 4096 || srv.Timeout != killTime {
+			t.Fatal("expected the configuration to be copied")
+		}
+		if srv.ConnTracker != nil {
+			t.Fatal("expected the ConnTracker not to be shared")
+		}
+		l, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go srv.Serve(l)
+		<-listened
+		clones = append(clones, srv)
+		addrs = append(addrs, l.Addr().String())
+	}
+	defer clones[1].StopWithResult(killTime)
+
+	// Stopping one clone leaves the other and the template alone.
+	if err := clones[0].StopWithResult(killTime); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-template.StopChan():
+		t.Fatal("expected the template not to be stopped")
+	case <-clones[1].StopChan():
+		t.Fatal("expected the second clone to keep running")
+	default:
+	}
+
+	r, err := http.Get("http://" + addrs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if string(body) != "hello" {
+		t.Fatalf("expected hello, got %q", body)
+	}
+}
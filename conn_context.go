@@ -0,0 +1,42 @@
+// +build go1.13
+
+package graceful
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// connContextKey is the request context key of the connection serving a
+// request.
+type connContextKey struct{}
+
+// connContextHook is the type of http.Server.ConnContext.
+type connContextHook func(ctx context.Context, c net.Conn) context.Context
+
+// installConnContext makes the http.Server store each connection in the
+// context of its requests, after calling the ConnContext it had before
+// the server first started, if any.
+func (srv *Server) installConnContext() {
+	if !srv.connContextSaved {
+		srv.connContext = srv.Server.ConnContext
+		srv.connContextSaved = true
+	}
+	base := srv.connContext
+	srv.Server.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		if base != nil {
+			ctx = base(ctx, c)
+		}
+		return context.WithValue(ctx, connContextKey{}, c)
+	}
+}
+
+// activeConn returns the connection serving r, from its context, or else
+// by searching the active connections with findActiveConn.
+func (srv *Server) activeConn(r *http.Request) (net.Conn, bool) {
+	if conn, ok := r.Context().Value(connContextKey{}).(net.Conn); ok {
+		return conn, true
+	}
+	return srv.findActiveConn(r)
+}
@@ -0,0 +1,21 @@
+// +build !go1.13
+
+package graceful
+
+import (
+	"net"
+	"net/http"
+)
+
+// connContextHook stands in for http.Server.ConnContext, which was added
+// in Go 1.13.
+type connContextHook struct{}
+
+// installConnContext is a no-op before Go 1.13.
+func (srv *Server) installConnContext() {}
+
+// activeConn returns the connection serving r, which before Go 1.13 can
+// only be found by searching the active connections.
+func (srv *Server) activeConn(r *http.Request) (net.Conn, bool) {
+	return srv.findActiveConn(r)
+}
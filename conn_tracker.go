@@ -0,0 +1,68 @@
+package graceful
+
+import (
+	"net"
+	"net/http"
+	"sync"
+)
+
+// ConnTracker keeps track of the connections of a Server and their states,
+// so that they can be drained on shutdown. Its methods are called from the
+// goroutines serving the connections, concurrently and without any other
+// locking, so an implementation that avoids a single lock, e.g. by sharding
+// connections across several maps, can be supplied through
+// Server.ConnTracker for servers handling a great many connections.
+type ConnTracker interface {
+	// SetState records that conn has moved to state. Connections moving to
+	// http.StateClosed are forgotten. Hijacked connections are reported as
+	// closed unless Server.OnHijackedShutdown is set. Calls for a single
+	// connection never overlap.
+	SetState(conn net.Conn, state http.ConnState)
+
+	// Len returns the number of connections recorded.
+	Len() int
+
+	// Range calls fn for every connection recorded, with its last state.
+	// Connections changing state during the call may or may not be seen.
+	Range(fn func(conn net.Conn, state http.ConnState))
+}
+
+// connTracker is the default ConnTracker, a map guarded by a mutex.
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]http.ConnState
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: map[net.Conn]http.ConnState{}}
+}
+
+func (t *connTracker) SetState(conn net.Conn, state http.ConnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if state == http.StateClosed {
+		delete(t.conns, conn)
+	} else {
+		t.conns[conn] = state
+	}
+}
+
+func (t *connTracker) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+func (t *connTracker) Range(fn func(conn net.Conn, state http.ConnState)) {
+	t.mu.Lock()
+	conns := make(map[net.Conn]http.ConnState, len(t.conns))
+	for conn, state := range t.conns {
+		conns[conn] = state
+	}
+	t.mu.Unlock()
+
+	for conn, state := range conns {
+		fn(conn, state)
+	}
+}
@@ -0,0 +1,95 @@
+package graceful
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingTracker is a ConnTracker that counts the state changes it sees.
+type countingTracker struct {
+	*connTracker
+	calls int32
+}
+
+func (t *countingTracker) SetState(conn net.Conn, state http.ConnState) {
+	atomic.AddInt32(&t.calls, 1)
+	t.connTracker.SetState(conn, state)
+}
+
+func TestCustomConnTracker(t *testing.T) {
+	server, l, err := createListener(killTime / 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracker := &countingTracker{connTracker: newConnTracker()}
+	srv := &Server{Server: server, Timeout: killTime, NoSignalHandling: true, ConnTracker: tracker}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	for i := 0; i < concurrentRequestN; i++ {
+		wg.Add(1)
+		go runQuery(t, http.StatusOK, false, &wg, &once)
+	}
+	time.Sleep(waitTime)
+
+	if n := srv.ActiveConnections(); n != concurrentRequestN {
+		t.Fatalf("expected %d connections in the tracker, got %d", concurrentRequestN, n)
+	}
+	if err := srv.StopWithResult(killTime); err != nil {
+		t.Fatalf("expected a clean shutdown, got %s", err)
+	}
+	wg.Wait()
+
+	if tracker.Len() != 0 {
+		t.Fatalf("expected the tracker to be empty, got %d connections", tracker.Len())
+	}
+	if atomic.LoadInt32(&tracker.calls) == 0 {
+		t.Fatal("the custom tracker was not used")
+	}
+}
+
+func TestConnTrackerRange(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	tracker := newConnTracker()
+	tracker.SetState(a, http.StateNew)
+	tracker.SetState(b, http.StateNew)
+	tracker.SetState(b, http.StateIdle)
+	tracker.SetState(a, http.StateClosed)
+
+	seen := map[net.Conn]http.ConnState{}
+	tracker.Range(func(conn net.Conn, state http.ConnState) { seen[conn] = state })
+	if len(seen) != 1 || seen[b] != http.StateIdle {
+		t.Fatalf("unexpected connections %v", seen)
+	}
+}
+
+// BenchmarkConnState measures the cost of tracking a connection through
+// its life, from being accepted to being closed.
+func BenchmarkConnState(b *testing.B) {
+	srv := &Server{Server: &http.Server{}}
+	hook := srv.connStateHook(newConnTracker(), make(chan struct{}, 1))
+	conns := make([]net.Conn, 1024)
+	for i := range conns {
+		conns[i] = &net.TCPConn{}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn := conns[i%len(conns)]
+		hook(conn, http.StateNew)
+		hook(conn, http.StateActive)
+		hook(conn, http.StateIdle)
+		hook(conn, http.StateClosed)
+	}
+}
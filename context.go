@@ -0,0 +1,210 @@
+// +build go1.7
+
+package graceful
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// ServeWithContext is equivalent to Serve, but also initiates shutdown when
+// ctx is done, as if the server had been interrupted but with
+// ReasonContext as the reason. The Timeout still applies to outstanding
+// requests once shutdown has started. If ctx is already done, it closes
+// listener and returns ctx's error without serving.
+func (srv *Server) ServeWithContext(ctx context.Context, listener net.Listener) error {
+	if err := ctx.Err(); err != nil {
+		listener.Close()
+		return err
+	}
+	interrupt := srv.interruptChan()
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			select {
+			case interrupt <- contextSignal{}:
+			case <-done:
+			}
+		case <-done:
+		}
+	}()
+
+	return srv.Serve(listener)
+}
+
+// ListenAndServeContext is equivalent to ListenAndServe, but serves with
+// ServeWithContext. If ctx is done before the address has been bound, it
+// returns ctx's error at once and stops any BindRetry, and the listener is
+// closed if binding completes later.
+func (srv *Server) ListenAndServeContext(ctx context.Context) error {
+	addr := srv.Addr
+	if addr == "" {
+		addr = ":http"
+	}
+	l, err := listenContext(ctx, func(done <-chan struct{}) (net.Listener, error) { return srv.listen(addr, done) })
+	if err != nil {
+		return err
+	}
+	return srv.ServeWithContext(ctx, l)
+}
+
+// ListenAndServeTLSContext is equivalent to ListenAndServeTLS, but serves
+// with ServeWithContext. Like ListenAndServeContext, it returns ctx's error
+// at once if ctx is done while the certificate is loaded or the address is
+// bound.
+func (srv *Server) ListenAndServeTLSContext(ctx context.Context, certFile, keyFile string) error {
+	l, err := listenContext(ctx, func(done <-chan struct{}) (net.Listener, error) {
+		return srv.listenTLS(certFile, keyFile, done)
+	})
+	if err != nil {
+		return err
+	}
+	return srv.ServeWithContext(ctx, l)
+}
+
+// listenContext calls listen with ctx.Done(), returning early with ctx's
+// error if ctx is done first. The listener is closed if it is created after
+// that.
+func listenContext(ctx context.Context, listen func(<-chan struct{}) (net.Listener, error)) (net.Listener, error) {
+	type result struct {
+		l   net.Listener
+		err error
+	}
+	c := make(chan result, 1)
+	go func() {
+		l, err := listen(ctx.Done())
+		c <- result{l, err}
+	}()
+
+	select {
+	case r := <-c:
+		if r.err == nil && ctx.Err() != nil {
+			r.l.Close()
+			return nil, ctx.Err()
+		}
+		return r.l, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-c; r.err == nil {
+				r.l.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// Shutdown gracefully shuts the server down like StopWithResult, but the
+// drain is bounded by ctx instead of the Timeout: once ctx is done, the
+// remaining connections are forcefully closed. It blocks until the server
+// has stopped or ctx is done, and then returns the result of the shutdown
+// or ctx's error. If the server is already shutting down, Shutdown only
+// waits for it; if it has not been started, it returns ErrNotRunning. It
+// replaces http.Server.Shutdown, which would shut the server down behind
+// graceful's back.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	if atomic.LoadInt32(&srv.state) == stateNew {
+		return ErrNotRunning
+	}
+	stop := srv.StopChan()
+
+	done := ctx.Done()
+	if done == nil {
+		// ctx is never done, so neither is the drain.
+		done = make(chan struct{})
+	}
+	deadline, _ := ctx.Deadline()
+	srv.requestStop(stopSignal{cancel: done, deadline: deadline})
+
+	select {
+	case <-stop:
+		srv.chanLock.RLock()
+		defer srv.chanLock.RUnlock()
+		return srv.stopErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// drainInfoKey is the context key under which Serve stores the server
+// handling each request, for DrainInfo.
+type drainInfoKey struct{}
+
+// DrainInfo returns the drain status of the server handling the request
+// whose context is ctx, so that handlers can cooperate with the drain, for
+// instance by cutting their work short to finish before the Deadline. It
+// is looked up when called, so requests in flight when draining starts see
+// it as well as new ones. It returns the zero DrainStatus for contexts not
+// derived from a request served by a Server.
+func DrainInfo(ctx context.Context) DrainStatus {
+	srv, ok := ctx.Value(drainInfoKey{}).(*Server)
+	if !ok {
+		return DrainStatus{}
+	}
+	return srv.drainStatus()
+}
+
+// requestGone returns channels of which one is closed once the client of
+// r has gone away: from Go 1.7, the Done channel of r's context.
+func requestGone(rw http.ResponseWriter, r *http.Request) (<-chan struct{}, <-chan bool) {
+	return r.Context().Done(), nil
+}
+
+// withDrainInfo wraps next so that DrainInfo works with the contexts of
+// the requests it handles.
+func (srv *Server) withDrainInfo(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), drainInfoKey{}, srv)))
+	})
+}
+
+// SetPriority sets the priority of r, which decides how it is treated if
+// the server drains while r is being handled: PriorityLow requests are cut
+// off as soon as draining starts, and PriorityHigh ones are kept past the
+// Timeout for the MaxDrainExtension. The priority applies to the connection
+// serving r and is cleared when the request finishes. It reports whether
+// the connection was found, which it may not be for the same reasons as
+// with ExtendDeadline, or when r was not served by a Server.
+func SetPriority(r *http.Request, p Priority) bool {
+	srv, ok := r.Context().Value(drainInfoKey{}).(*Server)
+	if !ok {
+		return false
+	}
+	return srv.setPriority(r, p)
+}
+
+// DrainWaiter is something other than connections that shutdown should
+// wait for, such as operations tracked in a registry of the application.
+type DrainWaiter interface {
+	// Wait blocks until it is safe to exit. ctx is done once the timeout
+	// has expired or the shutdown has been cut short.
+	Wait(ctx context.Context) error
+}
+
+// AddDrainWaiter makes shutdown wait for w alongside the connections, like
+// a task started with Go, up to the same Timeout. If Wait has not returned
+// once the timeout expires, it is counted in the Tasks of the TimeoutError.
+// Returning from Wait early, with or without an error, lets shutdown
+// proceed without it; errors are logged. It must be called before shutdown
+// starts.
+func (srv *Server) AddDrainWaiter(w DrainWaiter) {
+	srv.stopLock.Lock()
+	defer srv.stopLock.Unlock()
+
+	srv.drainWaiters = append(srv.drainWaiters, func(stop <-chan struct{}) error {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		return w.Wait(ctx)
+	})
+}
@@ -0,0 +1,21 @@
+// +build !go1.7
+
+package graceful
+
+import "net/http"
+
+// withDrainInfo returns next as is before Go 1.7, which lacks request
+// contexts.
+func (srv *Server) withDrainInfo(next http.Handler) http.Handler {
+	return next
+}
+
+// requestGone returns channels of which one delivers once the client of
+// r has gone away, if rw can tell. Before Go 1.7, which lacks request
+// contexts, that is CloseNotify.
+func requestGone(rw http.ResponseWriter, r *http.Request) (<-chan struct{}, <-chan bool) {
+	if cn, ok := rw.(http.CloseNotifier); ok {
+		return nil, cn.CloseNotify()
+	}
+	return nil, nil
+}
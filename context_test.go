@@ -0,0 +1,439 @@
+// +build go1.7
+
+package graceful
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServeWithContextCancel(t *testing.T) {
+	server, l, err := createListener(killTime / 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reason := make(chan string, 1)
+	srv := &Server{Timeout: killTime, Server: server, NoSignalHandling: true}
+	srv.ShutdownInitiated = func() { reason <- srv.drainStatus().Reason }
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ServeWithContext(ctx, l) }()
+	time.Sleep(waitTime)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	wg.Add(1)
+	go runQuery(t, http.StatusOK, false, &wg, &once)
+	time.Sleep(waitTime)
+
+	cancel()
+
+	select {
+	case err := <-errc:
+		if err != ErrServerClosed {
+			t.Fatalf("expected %v, got %v", ErrServerClosed, err)
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the context to stop the server")
+	}
+	wg.Wait()
+	if r := <-reason; r != ReasonContext {
+		t.Fatalf("expected %q as the reason, got %q", ReasonContext, r)
+	}
+}
+
+func TestListenAndServeContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	srv := &Server{Server: &http.Server{Addr: fmt.Sprintf(":%d", port)}, NoSignalHandling: true}
+	if err := srv.ListenAndServeContext(ctx); err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+
+	// The port was not left bound.
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+}
+
+func TestListenAndServeContextBindRetry(t *testing.T) {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var mu sync.Mutex
+	retries := 0
+	ctx, cancel := context.WithCancel(context.Background())
+	srv := &Server{Server: &http.Server{Addr: fmt.Sprintf(":%d", port)}, NoSignalHandling: true,
+		BindRetry: 10 * timeoutTime}
+	srv.LogFunc = func(format string, args ...interface{}) {
+		mu.Lock()
+		retries++
+		mu.Unlock()
+	}
+	time.AfterFunc(waitTime, cancel)
+	if err := srv.ListenAndServeContext(ctx); err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	mu.Lock()
+	before := retries
+	mu.Unlock()
+
+	// A retry already under way may still be logged, but no more.
+	time.Sleep(timeoutTime + waitTime*2)
+	mu.Lock()
+	defer mu.Unlock()
+	if retries > before+1 {
+		t.Fatalf("expected retrying to stop with the context, retried %d more times", retries-before)
+	}
+}
+
+func TestListenContextSlow(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	closed := make(chan struct{})
+	listen := func(<-chan struct{}) (net.Listener, error) {
+		<-ctx.Done()
+		time.Sleep(waitTime)
+		return closeHookListener{closed}, nil
+	}
+	time.AfterFunc(waitTime, cancel)
+
+	if _, err := listenContext(ctx, listen); err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	select {
+	case <-closed:
+		t.Fatal("expected listenContext to return before the listener was created")
+	default:
+	}
+	select {
+	case <-closed:
+	case <-time.After(timeoutTime):
+		t.Fatal("expected the late listener to be closed")
+	}
+}
+
+// closeHookListener is a listener that only reports being closed.
+type closeHookListener struct {
+	closed chan struct{}
+}
+
+func (l closeHookListener) Accept() (net.Conn, error) { return nil, errListenerClosed }
+func (l closeHookListener) Close() error              { close(l.closed); return nil }
+func (l closeHookListener) Addr() net.Addr            { return nil }
+
+func TestShutdownContextDeadline(t *testing.T) {
+	server, l, err := createListener(timeoutTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The Timeout is long enough that only the context can end the drain.
+	srv := &Server{Timeout: 10 * timeoutTime, Server: server, NoSignalHandling: true}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	wg.Add(1)
+	go runQuery(t, http.StatusOK, true, &wg, &once)
+	time.Sleep(waitTime)
+
+	ctx, cancel := context.WithTimeout(context.Background(), waitTime)
+	defer cancel()
+	start := time.Now()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	select {
+	case <-srv.StopChan():
+	case <-time.After(killTime):
+		t.Fatal("Timed out while waiting for the server to stop after the deadline")
+	}
+	if elapsed := time.Since(start); elapsed >= timeoutTime {
+		t.Fatalf("expected the shutdown to end at the deadline, took %v", elapsed)
+	}
+	if _, ok := srv.StopWithResult(0).(*TimeoutError); !ok {
+		t.Fatal("expected the remaining connection to be forcefully closed")
+	}
+	wg.Wait()
+}
+
+func TestShutdownClean(t *testing.T) {
+	server, l, err := createListener(waitTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Timeout: killTime, Server: server, NoSignalHandling: true}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	wg.Add(1)
+	go runQuery(t, http.StatusOK, false, &wg, &once)
+	time.Sleep(waitTime / 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutTime)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("expected a clean shutdown, got %v", err)
+	}
+	wg.Wait()
+}
+
+func TestShutdownNotRunning(t *testing.T) {
+	srv := &Server{Server: &http.Server{}}
+	if err := srv.Shutdown(context.Background()); err != ErrNotRunning {
+		t.Fatalf("expected %v, got %v", ErrNotRunning, err)
+	}
+}
+
+func TestDrainInfo(t *testing.T) {
+	started, release := make(chan DrainStatus), make(chan struct{})
+	srv := &Server{NoSignalHandling: true, Server: &http.Server{}}
+	srv.Handler = http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		started <- DrainInfo(r.Context())
+		<-release
+		started <- DrainInfo(r.Context())
+	})
+
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	go func() {
+		resp, err := http.Get(fmt.Sprintf("http://localhost:%d", port))
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	if info := <-started; info != (DrainStatus{}) {
+		t.Fatalf("expected no drain status before shutdown, got %+v", info)
+	}
+
+	stop := srv.StopChan()
+	srv.Stop(killTime)
+	for !srv.Draining() {
+		time.Sleep(time.Millisecond)
+	}
+	before := time.Now()
+	close(release)
+	info := <-started
+	if !info.Draining || info.Reason != ReasonStop {
+		t.Fatalf("expected a drain initiated by Stop, got %+v", info)
+	}
+	if info.Deadline.After(before.Add(killTime)) || info.Deadline.Before(before.Add(killTime-waitTime)) {
+		t.Fatalf("expected a deadline %s from now, got %s", killTime, info.Deadline.Sub(before))
+	}
+	<-stop
+
+	if info := DrainInfo(context.Background()); info != (DrainStatus{}) {
+		t.Fatalf("expected no drain status outside a request, got %+v", info)
+	}
+}
+
+func TestSetPriority(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ping", func(rw http.ResponseWriter, r *http.Request) {
+		SetPriority(r, PriorityLow)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(killTime * 2):
+		}
+	})
+	mux.HandleFunc("/pay", func(rw http.ResponseWriter, r *http.Request) {
+		SetPriority(r, PriorityHigh)
+		time.Sleep(killTime + waitTime*2)
+	})
+	srv := &Server{NoSignalHandling: true, MaxDrainExtension: killTime, Server: &http.Server{Handler: mux}}
+
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	get := func(path string, result chan<- error) {
+		resp, err := http.Get(fmt.Sprintf("http://localhost:%d%s", port, path))
+		if err == nil {
+			resp.Body.Close()
+		}
+		result <- err
+	}
+	ping, pay := make(chan error, 1), make(chan error, 1)
+	go get("/ping", ping)
+	go get("/pay", pay)
+	time.Sleep(waitTime)
+
+	start := time.Now()
+	stopped := make(chan error, 1)
+	go func() { stopped <- srv.StopWithResult(killTime) }()
+
+	if err := <-ping; err == nil {
+		t.Fatal("expected the low priority request to be cut off")
+	}
+	if d := time.Since(start); d > waitTime {
+		t.Fatalf("expected the low priority request to be cut off right away, took %s", d)
+	}
+	if err := <-pay; err != nil {
+		t.Fatalf("expected the high priority request to complete, got %s", err)
+	}
+	if err := <-stopped; err != nil {
+		t.Fatalf("expected a clean shutdown, got %s", err)
+	}
+}
+
+// registry is a DrainWaiter that waits for its operations to finish.
+type registry struct {
+	sync.WaitGroup
+	canceled chan struct{}
+}
+
+func (r *registry) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		r.WaitGroup.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		close(r.canceled)
+		return ctx.Err()
+	}
+}
+
+func TestDrainWaiter(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: server, NoSignalHandling: true}
+	ops := &registry{canceled: make(chan struct{})}
+	srv.AddDrainWaiter(ops)
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	ops.Add(1)
+	go func() {
+		time.Sleep(killTime / 2)
+		ops.Done()
+	}()
+
+	start := time.Now()
+	if err := srv.StopWithResult(killTime); err != nil {
+		t.Fatalf("expected a clean shutdown, got %s", err)
+	}
+	if time.Since(start) < killTime/2 {
+		t.Fatal("shutdown should wait for the registry to be empty")
+	}
+}
+
+func TestDrainWaiterTimesOut(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: server, NoSignalHandling: true}
+	ops := &registry{canceled: make(chan struct{})}
+	ops.Add(1)
+	defer ops.Done()
+	srv.AddDrainWaiter(ops)
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	err = srv.StopWithResult(killTime)
+	terr, ok := err.(*TimeoutError)
+	if !ok || terr.Tasks != 1 {
+		t.Fatalf("expected a *TimeoutError with 1 task, got %#v", err)
+	}
+	select {
+	case <-ops.canceled:
+	case <-time.After(timeoutTime):
+		t.Fatal("expected the waiter's context to be canceled")
+	}
+}
+
+func TestShutdownBackground(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reason := make(chan string, 1)
+	srv := &Server{Timeout: killTime, Server: server, NoSignalHandling: true}
+	srv.ShutdownInitiated = func() { reason <- srv.drainStatus().Reason }
+	go srv.Serve(l)
+	<-srv.Ready()
+
+	// A context that is never done is still a context, not a Stop.
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-reason; r != ReasonContext {
+		t.Fatalf("expected %q as the reason, got %q", ReasonContext, r)
+	}
+}
+
+func TestShutdownVetoedThenSignal(t *testing.T) {
+	server, l, err := createListener(killTime / 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first shutdown is vetoed, and the next one goes ahead.
+	asked, vetoed := make(chan struct{}, 2), false
+	srv := &Server{Timeout: killTime, Server: server, NoSignalHandling: true}
+	srv.BeforeShutdown = func() bool {
+		allow := vetoed
+		vetoed = true
+		asked <- struct{}{}
+		return allow
+	}
+	go srv.Serve(l)
+	<-srv.Ready()
+
+	// The Shutdown is vetoed, so its done context must not cut the drain
+	// of the next shutdown short.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	srv.Shutdown(ctx)
+	<-asked
+
+	result := make(chan error, 1)
+	go func() {
+		r, err := http.Get(fmt.Sprintf("http://localhost:%d", port))
+		if err == nil {
+			r.Body.Close()
+		}
+		result <- err
+	}()
+	time.Sleep(waitTime)
+	stop := srv.TriggerShutdown()
+	if err := <-result; err != nil {
+		t.Fatalf("expected the request to finish, got %v", err)
+	}
+	<-stop
+}
@@ -0,0 +1,47 @@
+package graceful
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// The reasons for a shutdown reported in DrainStatus.
+const (
+	// ReasonSignal is a signal, including those sent by TriggerShutdown
+	// and the ShutdownFile.
+	ReasonSignal = "signal"
+
+	// ReasonStop is a call to Stop or StopWithResult.
+	ReasonStop = "stop"
+
+	// ReasonContext is a call to Shutdown, or the context given to
+	// ServeWithContext being done.
+	ReasonContext = "context"
+)
+
+// DrainStatus describes the shutdown of a server, as returned by DrainInfo.
+type DrainStatus struct {
+	// Draining is set once the server has stopped accepting connections
+	// and is waiting for the open ones to finish.
+	Draining bool
+
+	// Reason is why shutdown was initiated: ReasonSignal, ReasonStop or
+	// ReasonContext. It is set from when shutdown is initiated, which may
+	// be a GraceWindow before draining starts.
+	Reason string
+
+	// Deadline is when the remaining connections will be forcefully
+	// closed, or zero if that is not known, for instance because there is
+	// no timeout.
+	Deadline time.Time
+}
+
+// drainStatus returns the current DrainStatus of the server.
+func (srv *Server) drainStatus() DrainStatus {
+	if atomic.LoadInt32(&srv.shuttingDown) == 0 && !srv.Draining() {
+		return DrainStatus{}
+	}
+	srv.stopLock.Lock()
+	defer srv.stopLock.Unlock()
+	return DrainStatus{Draining: srv.Draining(), Reason: srv.reason, Deadline: srv.deadline}
+}
@@ -0,0 +1,71 @@
+package graceful
+
+import "net"
+
+// ListenTCP4 creates a listener on the server's Addr that only accepts
+// IPv4 connections. Pass it to Serve to serve on it with graceful
+// shutdown. A host name in Addr is resolved to its IPv4 address.
+func (srv *Server) ListenTCP4() (net.Listener, error) {
+	return srv.bind("tcp4", srv.tcpAddr(), nil)
+}
+
+// ListenTCP6 creates a listener on the server's Addr that only accepts
+// IPv6 connections. Pass it to Serve to serve on it with graceful
+// shutdown. A host name in Addr is resolved to its IPv6 address.
+func (srv *Server) ListenTCP6() (net.Listener, error) {
+	return srv.bind("tcp6", srv.tcpAddr(), nil)
+}
+
+// tcpAddr returns the Addr to listen on, defaulting to ":http".
+func (srv *Server) tcpAddr() string {
+	if srv.Addr == "" {
+		return ":http"
+	}
+	return srv.Addr
+}
+
+// listenDualStack listens on addr over both IPv4 and IPv6. A wildcard host
+// is bound as the unspecified IPv6 address, which also accepts IPv4. A host
+// name with addresses in both families gets a listener for each, which are
+// served as one; if only one family resolves, only it is listened on.
+func (srv *Server) listenDualStack(addr string, cancel <-chan struct{}) (net.Listener, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, &BindError{Addr: addr, Err: err}
+	}
+	switch host {
+	case "", "0.0.0.0", "::":
+		return srv.bind("tcp", net.JoinHostPort("::", port), cancel)
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, &BindError{Addr: addr, Err: err}
+	}
+	var v4, v6 net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			if v4 == nil {
+				v4 = ip
+			}
+		} else if v6 == nil {
+			v6 = ip
+		}
+	}
+	if v4 == nil || v6 == nil {
+		return srv.bind("tcp", addr, cancel)
+	}
+
+	l4, err := srv.bind("tcp4", net.JoinHostPort(v4.String(), port), cancel)
+	if err != nil {
+		return nil, err
+	}
+	// Use the port actually bound, in case addr asked for any port.
+	_, port, _ = net.SplitHostPort(l4.Addr().String())
+	l6, err := srv.bind("tcp6", net.JoinHostPort(v6.String(), port), cancel)
+	if err != nil {
+		l4.Close()
+		return nil, err
+	}
+	return newMultiListener([]net.Listener{l4, l6}), nil
+}
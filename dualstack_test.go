@@ -0,0 +1,80 @@
+package graceful
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestListenTCP4(t *testing.T) {
+	srv := &Server{Server: &http.Server{Addr: "localhost:0"}}
+	l, err := srv.ListenTCP4()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if ip := l.Addr().(*net.TCPAddr).IP; ip.To4() == nil {
+		t.Fatalf("expected an IPv4 address, got %s", ip)
+	}
+}
+
+func TestListenTCP6(t *testing.T) {
+	srv := &Server{Server: &http.Server{Addr: "[::1]:0"}}
+	l, err := srv.ListenTCP6()
+	if err != nil {
+		t.Skipf("IPv6 is not available: %s", err)
+	}
+	defer l.Close()
+	if ip := l.Addr().(*net.TCPAddr).IP; ip.To4() != nil {
+		t.Fatalf("expected an IPv6 address, got %s", ip)
+	}
+}
+
+func TestDualStack(t *testing.T) {
+	if l, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skipf("IPv6 is not available: %s", err)
+	} else {
+		l.Close()
+	}
+
+	for _, addr := range []string{"0.0.0.0:0", "localhost:0"} {
+		srv := &Server{Server: &http.Server{Addr: addr}, DualStack: true}
+		l, err := srv.listen(addr, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, port, _ := net.SplitHostPort(l.Addr().String())
+
+		for _, host := range []string{"127.0.0.1", "::1"} {
+			if addr == "localhost:0" && !resolves("localhost", host) {
+				continue
+			}
+			go func() {
+				if c, err := l.Accept(); err == nil {
+					c.Close()
+				}
+			}()
+			c, err := net.Dial("tcp", net.JoinHostPort(host, port))
+			if err != nil {
+				t.Errorf("%s: expected %s to be served, got %v", addr, host, err)
+				continue
+			}
+			c.Close()
+		}
+		l.Close()
+	}
+}
+
+// resolves reports whether host resolves to ip.
+func resolves(host, ip string) bool {
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return false
+	}
+	for _, i := range ips {
+		if i.String() == ip {
+			return true
+		}
+	}
+	return false
+}
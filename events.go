@@ -0,0 +1,94 @@
+package graceful
+
+import "time"
+
+// The kinds of Event sent on the Events channel.
+const (
+	// EventListen is sent once the server is about to accept
+	// connections. Its Detail is the address of the listener.
+	EventListen = "listen"
+
+	// EventShutdown is sent when shutdown is initiated. Its Detail is the
+	// reason: ReasonSignal, ReasonStop or ReasonContext.
+	EventShutdown = "shutdown"
+
+	// EventDrainStart is sent once the listener is closed and the open
+	// connections start draining.
+	EventDrainStart = "drain-start"
+
+	// EventDrainTick is sent every DrainTickInterval while draining.
+	EventDrainTick = "drain-tick"
+
+	// EventTimeout is sent when the timeout expires, before the remaining
+	// connections are forcefully closed.
+	EventTimeout = "timeout"
+
+	// EventStopped is sent once the server has stopped. Its Detail is the
+	// error the shutdown resulted in, if any. It is the last event.
+	EventStopped = "stopped"
+)
+
+// eventBuffer is how many events the Events channel holds.
+const eventBuffer = 64
+
+// Event describes a step in the lifecycle of a server, as sent on the
+// Events channel.
+type Event struct {
+	// Kind is one of the Event constants, such as EventDrainStart.
+	Kind string
+
+	// Timestamp is when the event happened, according to the Clock.
+	Timestamp time.Time
+
+	// ActiveConns is the number of connections open at the time.
+	ActiveConns int
+
+	// Detail gives more information for some kinds of events.
+	Detail string
+}
+
+// Events gets a channel on which the server sends an Event for each step
+// of its lifecycle, for dashboards and other programmatic consumers. Events
+// are only sent once Events has been called. The channel holds up to 64
+// events; while it is full, further events are dropped rather than holding
+// up the server, so consumers should keep receiving. It is closed after
+// the EventStopped event.
+func (srv *Server) Events() <-chan Event {
+	srv.chanLock.Lock()
+	defer srv.chanLock.Unlock()
+
+	if srv.eventChan == nil {
+		srv.eventChan = make(chan Event, eventBuffer)
+	}
+	return srv.eventChan
+}
+
+// emit sends an event of the given kind on the Events channel, if it is
+// being used, and closes the channel after EventStopped.
+func (srv *Server) emit(kind, detail string) {
+	if !srv.eventsEnabled() {
+		return
+	}
+	e := Event{Kind: kind, Timestamp: srv.clock().Now(), ActiveConns: srv.ActiveConnections(), Detail: detail}
+
+	srv.chanLock.Lock()
+	defer srv.chanLock.Unlock()
+	if srv.eventsClosed {
+		return
+	}
+	select {
+	case srv.eventChan <- e:
+	default:
+	}
+	if kind == EventStopped {
+		srv.eventsClosed = true
+		close(srv.eventChan)
+	}
+}
+
+// eventsEnabled reports whether Events has been called.
+func (srv *Server) eventsEnabled() bool {
+	srv.chanLock.RLock()
+	defer srv.chanLock.RUnlock()
+	return srv.eventChan != nil
+}
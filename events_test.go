@@ -0,0 +1,68 @@
+package graceful
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEvents(t *testing.T) {
+	server, l, err := createListener(killTime * 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Server: server, NoSignalHandling: true, DrainTickInterval: waitTime}
+	events := srv.Events()
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	wg.Add(1)
+	go runQuery(t, 0, true, &wg, &once)
+	time.Sleep(waitTime)
+
+	srv.Stop(killTime)
+	var kinds []string
+	for e := range events {
+		if len(kinds) == 0 || kinds[len(kinds)-1] != e.Kind {
+			kinds = append(kinds, e.Kind)
+		}
+		switch e.Kind {
+		case EventShutdown:
+			if e.Detail != ReasonStop {
+				t.Errorf("expected the shutdown reason to be %q, got %q", ReasonStop, e.Detail)
+			}
+		case EventDrainStart:
+			if e.ActiveConns != 1 {
+				t.Errorf("expected 1 connection when draining starts, got %d", e.ActiveConns)
+			}
+		case EventStopped:
+			if e.Detail == "" {
+				t.Error("expected the timeout error in the stopped event")
+			}
+		}
+	}
+	wg.Wait()
+
+	expected := []string{EventListen, EventShutdown, EventDrainStart, EventDrainTick, EventTimeout, EventStopped}
+	if len(kinds) != len(expected) {
+		t.Fatalf("expected events %v, got %v", expected, kinds)
+	}
+	for i := range expected {
+		if kinds[i] != expected[i] {
+			t.Fatalf("expected events %v, got %v", expected, kinds)
+		}
+	}
+}
+
+func TestEventsDropped(t *testing.T) {
+	srv := &Server{}
+	events := srv.Events()
+	for i := 0; i < eventBuffer*2; i++ {
+		srv.emit(EventDrainTick, "")
+	}
+	if n := len(events); n != eventBuffer {
+		t.Fatalf("expected the channel to hold %d events, got %d", eventBuffer, n)
+	}
+}
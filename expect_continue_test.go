@@ -0,0 +1,125 @@
+package graceful
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// expectContinue sends the headers of a request with a body of
+// len(body) bytes that waits for 100 Continue on conn.
+func expectContinue(conn net.Conn, body string) {
+	fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: %d\r\n\r\n", len(body))
+}
+
+func TestExpectContinueInFlight(t *testing.T) {
+	started := make(chan struct{})
+	srv := &Server{Timeout: 5 * timeoutTime, NoSignalHandling: true}
+	srv.Server = &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		close(started)
+		for !srv.Draining() {
+			time.Sleep(time.Millisecond)
+		}
+		// Reading the body sends 100 Continue, even while draining.
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprint(rw, len(body))
+	})}
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * timeoutTime))
+	expectContinue(conn, "hello")
+	<-started
+
+	result := make(chan error, 1)
+	go func() { result <- srv.StopWithResult(5 * timeoutTime) }()
+
+	br := bufio.NewReader(conn)
+	line, err := br.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "HTTP/1.1 100") {
+		t.Fatalf("expected 100 Continue, got %q, %v", line, err)
+	}
+	br.ReadString('\n')
+	fmt.Fprint(conn, "hello")
+
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "5" {
+		t.Fatalf("expected the whole body to be read, got %d %q", resp.StatusCode, body)
+	}
+	if err := <-result; err != nil {
+		t.Fatalf("expected a clean shutdown, got %s", err)
+	}
+}
+
+func TestExpectContinueRefused(t *testing.T) {
+	srv := &Server{Timeout: 5 * timeoutTime, NoSignalHandling: true, NoCloseIdle: true}
+	srv.Server = &http.Server{Handler: srv.DrainMiddleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+	}))}
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * timeoutTime))
+
+	// The kept-alive connection sends a request that waits for 100
+	// Continue once draining has started.
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	result := make(chan error, 1)
+	go func() { result <- srv.StopWithResult(5 * timeoutTime) }()
+	for !srv.Draining() {
+		time.Sleep(time.Millisecond)
+	}
+	expectContinue(conn, "hello")
+
+	// It is refused without being asked for the body, and the connection
+	// is closed, so the drain ends without waiting for the Timeout.
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 instead of 100 Continue, got %d", resp.StatusCode)
+	}
+	if err := <-result; err != nil {
+		t.Fatalf("expected a clean shutdown, got %s", err)
+	}
+}
@@ -0,0 +1,141 @@
+package graceful
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// ExtendDeadline marks the connection serving r as needing more time to
+// drain than the timeout allows, for instance because it is receiving a
+// large upload. If the server is shut down while the request is being
+// handled, the connection is only forcefully closed once the
+// MaxDrainExtension has expired on top of the timeout. The mark is
+// cleared when the request finishes. It reports whether the connection
+// was found, which before Go 1.13 it may not be when the server listens
+// on a socket whose remote addresses are not unique, such as a Unix
+// socket.
+func (srv *Server) ExtendDeadline(r *http.Request) bool {
+	conn, ok := srv.activeConn(r)
+	if !ok {
+		return false
+	}
+
+	srv.extendLock.Lock()
+	defer srv.extendLock.Unlock()
+	if srv.extended == nil {
+		srv.extended = map[net.Conn]struct{}{}
+	}
+	srv.extended[conn] = struct{}{}
+	return true
+}
+
+// findActiveConn returns the connection serving r, found by its remote
+// address among the active connections. It reports false if there is no
+// such connection or more than one. It is only used when the connection
+// is not in the request context, which takes a pass over every
+// connection.
+func (srv *Server) findActiveConn(r *http.Request) (net.Conn, bool) {
+	srv.chanLock.RLock()
+	tracker := srv.tracker
+	srv.chanLock.RUnlock()
+	if tracker == nil {
+		return nil, false
+	}
+
+	var found []net.Conn
+	tracker.Range(func(conn net.Conn, state http.ConnState) {
+		if state == http.StateActive && conn.RemoteAddr().String() == r.RemoteAddr {
+			found = append(found, conn)
+		}
+	})
+	if len(found) != 1 {
+		return nil, false
+	}
+	return found[0], true
+}
+
+// unextend clears the mark set by ExtendDeadline on conn.
+func (srv *Server) unextend(conn net.Conn) {
+	srv.extendLock.Lock()
+	defer srv.extendLock.Unlock()
+	delete(srv.extended, conn)
+}
+
+// spared returns the connections in tracker that may keep draining once
+// the timeout has expired, and for how much longer: those marked with
+// ExtendDeadline, for the MaxDrainExtension, and those ShouldForceClose
+// spares, for the ForceCloseGrace. If both are spared, they all get the
+// longer of the two.
+func (srv *Server) spared(tracker ConnTracker) (map[net.Conn]struct{}, time.Duration) {
+	keep := map[net.Conn]struct{}{}
+	var extension time.Duration
+	var conns []net.Conn
+	srv.extendLock.Lock()
+	tracker.Range(func(conn net.Conn, state http.ConnState) {
+		if _, ok := srv.extended[conn]; ok && srv.MaxDrainExtension > 0 {
+			keep[conn] = struct{}{}
+			extension = srv.MaxDrainExtension
+		} else {
+			conns = append(conns, conn)
+		}
+	})
+	srv.extendLock.Unlock()
+
+	if srv.ShouldForceClose == nil || srv.ForceCloseGrace <= 0 {
+		return keep, extension
+	}
+	for _, conn := range conns {
+		if !srv.shouldForceClose(conn) {
+			keep[conn] = struct{}{}
+			if srv.ForceCloseGrace > extension {
+				extension = srv.ForceCloseGrace
+			}
+		}
+	}
+	return keep, extension
+}
+
+// shouldForceClose calls ShouldForceClose for conn, closing it if the
+// hook panics.
+func (srv *Server) shouldForceClose(conn net.Conn) (force bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			srv.logf("[ERROR] ShouldForceClose panic: %v", r)
+			force = true
+		}
+	}()
+	return srv.ShouldForceClose(conn)
+}
+
+// wasCut reports whether conn was closed by killUnspared, so that it is
+// not counted as drained cleanly when it is reported closed.
+func (srv *Server) wasCut(conn net.Conn) bool {
+	srv.extendLock.Lock()
+	defer srv.extendLock.Unlock()
+	_, ok := srv.cut[conn]
+	delete(srv.cut, conn)
+	return ok
+}
+
+// killUnspared forcefully closes the connections in tracker which are not
+// in keep, and returns their remote addresses.
+func (srv *Server) killUnspared(tracker ConnTracker, keep map[net.Conn]struct{}) []net.Addr {
+	srv.extendLock.Lock()
+	var conns []net.Conn
+	tracker.Range(func(conn net.Conn, state http.ConnState) {
+		if _, ok := keep[conn]; !ok {
+			conns = append(conns, conn)
+		}
+	})
+	if srv.cut == nil {
+		srv.cut = map[net.Conn]struct{}{}
+	}
+	for _, conn := range conns {
+		srv.cut[conn] = struct{}{}
+	}
+	srv.extendLock.Unlock()
+
+	srv.logf("timeout expired, closing %d connection(s), extending %d", len(conns), tracker.Len()-len(conns))
+	return srv.forceClose(tracker, conns)
+}
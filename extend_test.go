@@ -0,0 +1,199 @@
+package graceful
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestExtendDeadline(t *testing.T) {
+	srv := &Server{Timeout: waitTime, MaxDrainExtension: killTime, NoSignalHandling: true}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/upload", func(rw http.ResponseWriter, r *http.Request) {
+		if !srv.ExtendDeadline(r) {
+			t.Error("expected the connection to be found")
+		}
+		time.Sleep(killTime / 2)
+		rw.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/slow", func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(killTime)
+		rw.WriteHeader(http.StatusOK)
+	})
+	srv.Server = &http.Server{Handler: mux}
+
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	get := func(path string) <-chan error {
+		errc := make(chan error, 1)
+		go func() {
+			r, err := http.Get(fmt.Sprintf("http://localhost:%d%s", port, path))
+			if err == nil {
+				r.Body.Close()
+			}
+			errc <- err
+		}()
+		return errc
+	}
+	upload, slow := get("/upload"), get("/slow")
+	time.Sleep(waitTime / 2)
+
+	err = srv.StopWithResult(waitTime)
+	if err, ok := err.(*TimeoutError); !ok || err.Conns != 1 {
+		t.Fatalf("expected only the unmarked connection to be closed, got %v", err)
+	}
+	if err := <-upload; err != nil {
+		t.Fatalf("expected the extended upload to finish, got %v", err)
+	}
+	if err := <-slow; err == nil {
+		t.Fatal("expected the unmarked request to be cut off")
+	}
+}
+
+func TestExtendDeadlineExpires(t *testing.T) {
+	srv := &Server{Timeout: waitTime, MaxDrainExtension: waitTime, NoSignalHandling: true}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		srv.ExtendDeadline(r)
+		time.Sleep(killTime)
+		rw.WriteHeader(http.StatusOK)
+	})
+	srv.Server = &http.Server{Handler: mux}
+
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	errc := make(chan error, 1)
+	go func() {
+		r, err := http.Get(fmt.Sprintf("http://localhost:%d", port))
+		if err == nil {
+			r.Body.Close()
+		}
+		errc <- err
+	}()
+	time.Sleep(waitTime / 2)
+
+	start := time.Now()
+	if _, ok := srv.StopWithResult(waitTime).(*TimeoutError); !ok {
+		t.Fatal("expected the connection to be closed once the extension expired")
+	}
+	if elapsed := time.Since(start); elapsed >= killTime {
+		t.Fatalf("expected the extension to be bounded, took %v", elapsed)
+	}
+	if err := <-errc; err == nil {
+		t.Fatal("expected the request to be cut off")
+	}
+}
+
+func TestShouldForceClose(t *testing.T) {
+	var asked int32
+	srv := &Server{Timeout: waitTime, ForceCloseGrace: 2 * waitTime, NoSignalHandling: true,
+		ShouldForceClose: func(conn net.Conn) bool {
+			atomic.AddInt32(&asked, 1)
+			return false
+		}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/almost", func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(2 * waitTime)
+		rw.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/stuck", func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(killTime * 2)
+		rw.WriteHeader(http.StatusOK)
+	})
+	srv.Server = &http.Server{Handler: mux}
+
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	get := func(path string) <-chan error {
+		errc := make(chan error, 1)
+		go func() {
+			r, err := http.Get(fmt.Sprintf("http://localhost:%d%s", port, path))
+			if err == nil {
+				r.Body.Close()
+			}
+			errc <- err
+		}()
+		return errc
+	}
+	almost, stuck := get("/almost"), get("/stuck")
+	time.Sleep(waitTime / 2)
+
+	// Both are spared at the timeout, but only one finishes within the
+	// grace, and the other is closed without asking again.
+	err = srv.StopWithResult(waitTime)
+	if err, ok := err.(*TimeoutError); !ok || err.Conns != 1 {
+		t.Fatalf("expected only the stuck connection to be closed, got %v", err)
+	}
+	if err := <-almost; err != nil {
+		t.Fatalf("expected the spared request to finish, got %v", err)
+	}
+	if err := <-stuck; err == nil {
+		t.Fatal("expected the stuck request to be cut off after the grace")
+	}
+	if n := atomic.LoadInt32(&asked); n != 2 {
+		t.Fatalf("expected ShouldForceClose to be asked once per connection, got %d", n)
+	}
+}
+
+func TestDrainExemptHeader(t *testing.T) {
+	srv := &Server{Timeout: waitTime, MaxDrainExtension: killTime, DrainExemptHeader: "X-Graceful-NoDrain",
+		NoSignalHandling: true}
+	srv.Server = &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(killTime / 2)
+		rw.WriteHeader(http.StatusOK)
+	})}
+
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	get := func(exempt bool) <-chan error {
+		errc := make(chan error, 1)
+		go func() {
+			req, _ := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d", port), nil)
+			if exempt {
+				req.Header.Set("X-Graceful-NoDrain", "1")
+			}
+			r, err := http.DefaultClient.Do(req)
+			if err == nil {
+				r.Body.Close()
+			}
+			errc <- err
+		}()
+		return errc
+	}
+	exempt, normal := get(true), get(false)
+	time.Sleep(waitTime / 2)
+
+	err = srv.StopWithResult(waitTime)
+	if err, ok := err.(*TimeoutError); !ok || err.Conns != 1 {
+		t.Fatalf("expected only the request without the header to be cut off, got %v", err)
+	}
+	if err := <-exempt; err != nil {
+		t.Fatalf("expected the exempt request to finish, got %v", err)
+	}
+	if err := <-normal; err == nil {
+		t.Fatal("expected the request without the header to be cut off")
+	}
+}
@@ -2,12 +2,18 @@ package graceful
 
 import (
 	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -23,20 +29,259 @@ import (
 //	}
 //	srv.ListenAndServe()
 type Server struct {
+	// served counts the connections accepted, for Stats. It comes first
+	// so that it is 64-bit aligned for atomic access on 32-bit platforms.
+	served int64
+
 	*http.Server
 
 	// Timeout is the duration to allow outstanding requests to survive
-	// before forcefully terminating them.
+	// before forcefully terminating them. It starts for all connections
+	// at once, when draining begins, so every in-flight request gets the
+	// full Timeout: a slow request does not take time away from the
+	// others, and only the connections still open when it expires are
+	// closed. If zero, connections are never forcefully closed, unless
+	// Stop is called with a timeout.
 	Timeout time.Duration
 
-	// Limit the number of outstanding requests
+	// DrainForever makes shutdown wait for every connection to finish on
+	// its own, however long that takes: the timeout is never armed, not
+	// even when one is passed to Stop. Only ImmediateSignals and the
+	// context passed to Shutdown still close connections forcefully.
+	DrainForever bool
+
+	// TimeoutJitter adds a random duration of up to TimeoutJitter to the
+	// timeout, so that a fleet of servers shut down at the same moment does
+	// not force-close its connections all at once. It does not lengthen a
+	// zero timeout.
+	TimeoutJitter time.Duration
+
+	// JitterSource is the source of the TimeoutJitter. If nil, a source
+	// seeded from the time and process ID is used; tests can set a seeded
+	// one to make the timeout deterministic.
+	JitterSource rand.Source
+
+	// SoftTimeout splits draining into two phases. For SoftTimeout after
+	// draining begins, open connections are still served normally, so
+	// clients may send further requests on kept-alive connections; only
+	// new connections are refused. Once it expires, keep-alives are
+	// disabled, so responses carry "Connection: close", idle connections
+	// are closed and no more requests are accepted. Connections still open
+	// once the hard timeout expires are forcefully closed. Zero disables
+	// the first phase, as if it expired immediately. It is ignored with
+	// UseStdlibShutdown.
+	SoftTimeout time.Duration
+
+	// HardTimeout is the duration after which the remaining connections
+	// are forcefully closed, counted from when draining begins. If zero,
+	// Timeout is used. A timeout passed to Stop overrides both.
+	HardTimeout time.Duration
+
+	// DrainExemptHeader, if set, names a request header that marks
+	// requests as needing to survive a shutdown: when it is set to any
+	// value, the request's connection is marked with ExtendDeadline, so it
+	// may drain for the MaxDrainExtension past the timeout. Clients can
+	// set any header, so it should be stripped from outside requests, for
+	// instance by a proxy in front of the server.
+	DrainExemptHeader string
+
+	// PerConnTimeout makes the timeout scale with the load: if it is set, the
+	// connections may drain for BaseTimeout plus PerConnTimeout for each
+	// connection open when draining begins, up to MaxTimeout if that is
+	// set, instead of for Timeout or HardTimeout. A timeout passed to
+	// Stop still overrides it.
+	PerConnTimeout time.Duration
+
+	// BaseTimeout is the part of the timeout that does not depend on the
+	// number of connections when PerConnTimeout is set.
+	BaseTimeout time.Duration
+
+	// MaxTimeout caps the timeout computed from PerConnTimeout. Zero means
+	// no cap.
+	MaxTimeout time.Duration
+
+	// MaxDrainExtension is how much longer than the hard timeout the
+	// connections marked with ExtendDeadline may keep draining, so that
+	// known long operations such as uploads are not cut off. Unmarked
+	// connections are still forcefully closed when the timeout expires.
+	// Zero disables extensions.
+	MaxDrainExtension time.Duration
+
+	// ShouldForceClose, if set, is called for each connection still open
+	// when the timeout expires, and may return false to spare it for the
+	// ForceCloseGrace, for instance because it is about to finish. The
+	// connections still open once that has expired are forcefully closed
+	// without asking again. Connections spared by ExtendDeadline are not
+	// passed to it.
+	ShouldForceClose func(conn net.Conn) bool
+
+	// ForceCloseGrace is how much longer than the timeout the connections
+	// spared by ShouldForceClose may keep draining. Zero means
+	// ShouldForceClose is not called.
+	ForceCloseGrace time.Duration
+
+	// RequestTimeout limits how long a single request may be handled,
+	// at any time and not only during shutdown. Requests that take longer
+	// are answered with 503 Service Unavailable, using http.TimeoutHandler,
+	// so that stuck handlers do not hold up shutdown. Zero means no limit.
+	RequestTimeout time.Duration
+
+	// MaxBodyBytes limits the size of request bodies, so that clients
+	// cannot hold up shutdown by sending huge uploads. Requests whose
+	// Content-Length is larger are answered with 413 Request Entity Too
+	// Large without calling the handler; other bodies are wrapped with
+	// http.MaxBytesReader, which fails reads past the limit and closes the
+	// connection. Zero means no limit. The size of request headers is
+	// limited by the MaxHeaderBytes of the embedded http.Server.
+	MaxBodyBytes int64
+
+	// MaxWorkers limits how many requests are handled at once. Further
+	// requests wait, in the order they arrive, for one of them to finish;
+	// once QueueSize are waiting, more are answered with 503 Service
+	// Unavailable and a Retry-After header, and so are the requests still
+	// waiting once draining starts. With RequestTimeout, the wait counts
+	// towards the timeout, and a request that times out keeps its worker
+	// until its handler returns. Zero means no limit.
+	MaxWorkers int
+
+	// QueueSize is how many requests may wait for a worker when MaxWorkers
+	// is set. Zero means requests are refused as soon as every worker is
+	// busy.
+	QueueSize int
+
+	// ConnCloseTimeout bounds how long a connection may take, while
+	// draining, to send the rest of a response once its handler has
+	// returned, so that a client that stops reading cannot hold up
+	// shutdown until the Timeout. A write deadline is set on the connection
+	// when the handler returns, and the connection is closed when it
+	// passes. It does not apply before draining starts. Before Go 1.13,
+	// connections whose remote address is not unique, such as on a Unix
+	// socket, are not bounded. Zero disables it.
+	ConnCloseTimeout time.Duration
+
+	// SlowClientTimeout closes connections that have not finished sending
+	// the headers of their first request this long after being accepted,
+	// so that slow-loris clients trickling headers can neither hold
+	// connections open nor hold up shutdown. Such connections are not
+	// counted as forcefully closed. Unlike the ReadHeaderTimeout of the
+	// embedded http.Server, which ApplyTimeouts sets by default, it is
+	// enforced by graceful, so it also works before Go 1.8. Zero disables
+	// it.
+	SlowClientTimeout time.Duration
+
+	// UseStdlibShutdown makes the server drain connections with
+	// http.Server.Shutdown, bounded by Timeout, instead of tracking idle
+	// connections itself. Connections still open when the timeout expires
+	// are forcefully closed as usual. It requires Go 1.8 and is ignored on
+	// older versions.
+	UseStdlibShutdown bool
+
+	// NoDefaultTimeouts stops Serve from calling ApplyTimeouts, leaving
+	// the timeouts of the embedded http.Server exactly as they are.
+	NoDefaultTimeouts bool
+
+	// NoCloseIdle leaves idle keep-alive connections open when draining
+	// starts, instead of closing them right away. They are then closed when
+	// the client hangs up, after the next request on them, when the
+	// IdleTimeout expires, or forcefully once the timeout expires. HTTP/2 clients are
+	// not sent a GOAWAY frame. It is ignored with UseStdlibShutdown.
+	NoCloseIdle bool
+
+	// DrainRequests makes draining wait until no request is in flight
+	// rather than until every connection has closed. The connections still
+	// open then, such as kept-alive ones between requests, are closed, which
+	// does not count as forcefully closing them. Requests are only counted
+	// by CountingHandler, so every handler must be wrapped in it, or the
+	// requests it does not see may be cut off.
+	DrainRequests bool
+
+	// AcceptBackoffMax caps the delay before accepting again after a
+	// temporary error, e.g. running out of file descriptors. The delay
+	// starts at 5ms and doubles with every consecutive error. It defaults
+	// to one second. Shutdown does not wait for the delay to pass.
+	AcceptBackoffMax time.Duration
+
+	// ListenLimit limits the number of simultaneously open connections.
+	// Accept blocks while the limit is reached. Zero means no limit.
 	ListenLimit int
 
+	// WarmupRate limits how many connections are accepted per second for
+	// the WarmupDuration after serving begins, so that clients reconnecting
+	// all at once after a deploy do not overwhelm cold caches. Further
+	// connections wait in the listen backlog. The limit is lifted as soon
+	// as shutdown is initiated. Zero for either disables it.
+	WarmupRate     int
+	WarmupDuration time.Duration
+
 	// TCPKeepAlive sets the TCP keep-alive timeouts on accepted
 	// connections. It prunes dead TCP connections ( e.g. closing
-	// laptop mid-download)
+	// laptop mid-download). It has no effect on non-TCP connections,
+	// and zero leaves the connections' keep-alive settings unchanged.
 	TCPKeepAlive time.Duration
 
+	// ProxyProtocol makes the server expect a version 1 or 2 PROXY
+	// protocol header, as sent by load balancers such as HAProxy or AWS
+	// ELB, at the start of every connection. The client address from the
+	// header is used as the connection's RemoteAddr, and so as the
+	// RemoteAddr of its requests. Connections without a valid header are
+	// closed. With ListenAndServeTLS and its variants, the header is read
+	// before the TLS handshake, also for a listener from ListenTLS passed
+	// to ServeMulti or ServeTLSWithRedirect; a TLS listener passed to Serve
+	// directly must handle the header itself.
+	ProxyProtocol bool
+
+	// DualStack makes ListenAndServe and its variants listen on both IPv4
+	// and IPv6 for the host in Addr. Without it, the host decides: an empty
+	// host or "::" accepts both, "0.0.0.0" only IPv4, and a name such as
+	// "localhost" only the first address it resolves to, which is usually
+	// its IPv4 one. With it, "0.0.0.0" is treated like an empty host, and
+	// a name gets a listener for each of its IPv4 and IPv6 addresses. Such
+	// a pair of listeners cannot be passed on by Restart.
+	DualStack bool
+
+	// ReusePort makes ListenAndServe and its variants set SO_REUSEPORT on
+	// TCP listeners, so that several processes can serve the same port and
+	// each drain on its own. It needs Go 1.11 and Linux or a BSD; elsewhere,
+	// listening fails with ErrReusePortUnsupported.
+	ReusePort bool
+
+	// BindRetry makes ListenAndServe and its variants, and Preflight, keep
+	// trying to bind an address that is in use for up to that long, with
+	// a delay that starts at 5ms and doubles up to a second, e.g. while a
+	// previous process is still exiting during development. Other errors
+	// are returned at once. Zero disables retries, so that a taken port is
+	// reported right away, as is usually best in production.
+	BindRetry time.Duration
+
+	// DrainResponse is an optional handler that writes the response to the
+	// requests refused by DrainMiddleware, e.g. to return an error payload
+	// in the format of the rest of an API. The connection is closed after
+	// it regardless. If nil, a 503 Service Unavailable is sent.
+	DrainResponse http.Handler
+
+	// DrainPipelined keeps HTTP/1.1 connections open while draining, so
+	// that requests the client had already pipelined behind the one being
+	// handled are refused with a clean 503, as by DrainMiddleware, rather
+	// than cut off. The request being handled when draining starts
+	// completes normally. A connection that becomes idle while draining is
+	// closed after a brief wait unless another request arrives on it. HTTP/2
+	// clients are not sent a GOAWAY frame. It is ignored with
+	// UseStdlibShutdown.
+	DrainPipelined bool
+
+	// OnAccept is an optional callback function that is called for each
+	// connection right after it is accepted, before it is served. The
+	// connection it returns is served and tracked in place of conn, so it
+	// can wrap conn to tag or limit it; if it returns an error, conn is
+	// closed instead. With ListenTLS, conn is a *tls.Conn, which must be
+	// returned as is for net/http to see the TLS connection state.
+	//
+	// It is called in a goroutine of its own for each connection, so that
+	// a slow callback does not hold up accepting others. With
+	// ProxyProtocol, the RemoteAddr of conn is the client's address from
+	// the PROXY header, and calling it waits for the header to arrive.
+	OnAccept func(conn net.Conn) (net.Conn, error)
+
 	// ConnState specifies an optional callback function that is
 	// called when a client connection changes state. This is a proxy
 	// to the underlying http.Server's ConnState, and the original
@@ -44,20 +289,145 @@ type Server struct {
 	ConnState func(net.Conn, http.ConnState)
 
 	// BeforeShutdown is an optional callback function that is called
-	// before the listener is closed. Returns true if shutdown is allowed
+	// before the listener is closed. Returns true if shutdown is allowed;
+	// if it returns false, the signal is ignored and the server keeps
+	// serving.
 	BeforeShutdown func() bool
 
+	// GraceWindow is how long the server keeps accepting and serving
+	// connections normally after shutdown is initiated, e.g. to give a
+	// load balancer time to notice the server is going away. It starts
+	// after BeforeShutdown and ShutdownInitiated have been called. The
+	// Timeout only starts once the grace window has passed and the
+	// listener has been closed. On Kubernetes, this is the delay that
+	// covers the propagation of the pod's removal from its endpoints.
+	GraceWindow time.Duration
+
 	// ShutdownInitiated is an optional callback function that is called
-	// when shutdown is initiated. It can be used to notify the client
+	// once when shutdown is initiated, before the listener is closed and
+	// before the timeout starts. It can be used to notify the client
 	// side of long lived connections (e.g. websockets) to reconnect.
+	// A panic in the callback is logged and does not prevent shutdown.
 	ShutdownInitiated func()
 
+	// OnListen is an optional callback function that is called with the
+	// address of the listener once it is bound, before the first
+	// connection is accepted, e.g. to register the server with service
+	// discovery. Connections wait until it returns, so the server is only
+	// published once it is ready; OnListenerClosed is the place to
+	// deregister it. A panic in the callback is logged and does not
+	// prevent serving.
+	OnListen func(addr net.Addr)
+
+	// OnListenerClosed is an optional callback function that is called
+	// once the listener has been closed, as draining starts, e.g. to begin
+	// tearing down downstream dependencies that new requests would need.
+	// It comes after ShutdownInitiated and before OnShutdownComplete, and
+	// runs while the open connections drain, so the drain is not delayed
+	// if it blocks. A panic in the callback is logged and does not prevent
+	// shutdown.
+	OnListenerClosed func()
+
+	// OnHijackedShutdown is an optional callback function that is called,
+	// in its own goroutine, for each hijacked connection (e.g. a websocket)
+	// when draining begins, so that it can be asked to close. If it is set,
+	// hijacked connections are drained like any other until the handler
+	// that hijacked them calls ReleaseHijacked; if it is not set, hijacked
+	// connections are not managed by graceful at all.
+	OnHijackedShutdown func(conn net.Conn)
+
+	// TunnelGrace is how long tunnels served by Tunnel may stay open once
+	// draining begins, before both of their ends are closed. It defaults
+	// to one second.
+	TunnelGrace time.Duration
+
+	// OnDrainTick is an optional callback function that is called every
+	// DrainTickInterval while shutdown waits for connections to finish,
+	// with the number of connections that remain. It is called from the
+	// goroutine waiting for the connections, so it should not block, or
+	// the timeout may be noticed late.
+	OnDrainTick func(remaining int)
+
+	// DrainTickInterval is the interval at which OnDrainTick is called and
+	// EventDrainTick is sent. It defaults to one second.
+	DrainTickInterval time.Duration
+
+	// OnShutdownComplete is an optional callback function that is called
+	// with statistics about the shutdown once all connections are finished
+	// or closed, just before the stop channel is closed. It can be used to
+	// record metrics.
+	OnShutdownComplete func(stats ShutdownStats)
+
+	// Clock is used to time the shutdown. If nil, the real time is used.
+	Clock Clock
+
+	// OnForceClose is an optional callback function that is called, in its
+	// own goroutine, for each connection that is forcefully closed once the
+	// timeout expires, just before it is closed, so that its RemoteAddr can
+	// still be logged. The connections are closed once all the calls have
+	// returned, or after forceCloseWait if some still have not.
+	OnForceClose func(conn net.Conn)
+
+	// ProfileOnTimeout, if set, receives the stacks of all goroutines when
+	// the timeout expires, before any connection is forcefully closed, to
+	// show what held up the drain.
+	ProfileOnTimeout io.Writer
+
+	// ConnTracker keeps track of the open connections. If nil, a map
+	// guarded by a mutex is used.
+	ConnTracker ConnTracker
+
 	// NoSignalHandling prevents graceful from automatically shutting down
-	// on SIGINT and SIGTERM. If set to true, you must shut down the server
-	// manually with Stop().
+	// on SIGINT and SIGTERM. If set to true, graceful never calls
+	// signal.Notify and you must shut down the server manually with Stop().
 	NoSignalHandling bool
 
-	// Logger used to notify of errors on startup and on stop.
+	// RestartOnHangup makes the server call Restart when it receives
+	// SIGHUP. It is ignored if NoSignalHandling is set.
+	RestartOnHangup bool
+
+	// ShutdownFile is the path of a file whose appearance shuts the
+	// server down as if SIGTERM had been received, for environments where
+	// only the file system can be used to control the server. It is
+	// checked every shutdownFilePoll, removed once it has been seen, and
+	// watched even if NoSignalHandling is set.
+	ShutdownFile string
+
+	// MemoryLimitBytes makes the server shut down, as if SIGTERM had been
+	// received, once the memory the Go runtime has obtained from the
+	// system exceeds it, so that a leaking instance drains and exits to
+	// be replaced. It is checked every MemoryCheckInterval, and watched
+	// even if NoSignalHandling is set. Zero means no limit.
+	MemoryLimitBytes uint64
+
+	// MemoryCheckInterval is how often memory use is checked against the
+	// MemoryLimitBytes. Each check briefly stops the world, so it should
+	// not be too short. It defaults to ten seconds.
+	MemoryCheckInterval time.Duration
+
+	// SdNotify makes the server tell systemd, through the NOTIFY_SOCKET
+	// of a Type=notify service, that it is ready once it is serving and
+	// that it is stopping once it starts draining. It does nothing if
+	// NOTIFY_SOCKET is not set.
+	SdNotify bool
+
+	// Signals lists the signals that initiate shutdown. If empty, the
+	// server shuts down on SIGINT and SIGTERM. It is ignored if
+	// NoSignalHandling is set.
+	Signals []os.Signal
+
+	// ImmediateSignals lists the signals that shut the server down
+	// immediately, e.g. SIGQUIT for a wedged process: the listener and
+	// all connections are closed right away, skipping BeforeShutdown,
+	// the GraceWindow and the drain Timeout. An immediate signal received
+	// while the server is already draining cuts the drain short. The stop
+	// channel is closed as usual. It is ignored if NoSignalHandling is set.
+	ImmediateSignals []os.Signal
+
+	// Logger used to notify of errors on startup and on stop, and of
+	// shutdown progress: when shutdown is initiated, how many connections
+	// are being drained, when the timeout expires and when shutdown is
+	// complete. Nothing is logged if both Logger and LogFunc are nil.
 	Logger *log.Logger
 
 	// LogFunc can be assigned with a logging function of your choice, allowing
@@ -75,18 +445,281 @@ type Server struct {
 	// stopLock is used to protect against concurrent calls to Stop
 	stopLock sync.Mutex
 
+	// cancel is the done channel of the context passed to Shutdown, if
+	// any. Protected by stopLock.
+	cancel <-chan struct{}
+
+	// initiated is when shutdown was initiated, reason why, and deadline
+	// when the remaining connections will be forcefully closed, if known.
+	// Protected by stopLock.
+	initiated time.Time
+	reason    string
+	deadline  time.Time
+
+	// redirectPort is the HTTPS port to which ServeTLSWithRedirect sends
+	// plain HTTP requests.
+	redirectPort string
+
 	// stopChan is the channel on which callers may block while waiting for
 	// the server to stop.
 	stopChan chan struct{}
 
+	// readyChan is the channel that is closed once the server is serving.
+	readyChan chan struct{}
+
+	// drainingChan is the channel that is closed once draining begins.
+	drainingChan chan struct{}
+
+	// eventChan is the channel returned by Events, and eventsClosed is set
+	// once it has been closed.
+	eventChan    chan Event
+	eventsClosed bool
+
+	// doneChan receives the result of the shutdown once the server has
+	// stopped.
+	doneChan chan error
+
+	// timedOutChan is the channel that is closed if the timeout expires
+	// before all connections have finished.
+	timedOutChan chan struct{}
+
 	// chanLock is used to protect access to the various channel constructors.
 	chanLock sync.RWMutex
 
-	// connections holds all connections managed by graceful
-	connections map[net.Conn]struct{}
+	// tracker holds all connections managed by graceful, and drainWake
+	// is signalled when one of them closes while draining. Both are set
+	// by Serve and protected by chanLock.
+	tracker   ConnTracker
+	drainWake chan struct{}
+
+	// hijackNotified holds the hijacked connections for which
+	// OnHijackedShutdown has been called, protected by hijackLock.
+	hijackNotified map[net.Conn]struct{}
+	hijackLock     sync.Mutex
+
+	// pipelineIdle holds the connections that became idle while draining
+	// with DrainPipelined, each with a channel that cancels its closing,
+	// protected by pipelineLock.
+	pipelineIdle map[net.Conn]chan struct{}
+	pipelineLock sync.Mutex
+
+	// extended holds the connections marked with ExtendDeadline and cut
+	// the ones forcefully closed while those drain on. Both are protected
+	// by extendLock.
+	extended   map[net.Conn]struct{}
+	cut        map[net.Conn]struct{}
+	extendLock sync.Mutex
+
+	// lowPriority holds the connections serving PriorityLow requests,
+	// protected by priorityLock.
+	lowPriority  map[net.Conn]struct{}
+	priorityLock sync.Mutex
+
+	// reading holds the timers that close the connections still reading
+	// their first request with SlowClientTimeout, protected by readingLock.
+	reading     map[net.Conn]*time.Timer
+	readingLock sync.Mutex
+
+	// handler is the handler requests are served with, taken from Handler
+	// by Serve and replaced by SetHandler. Protected by handlerLock.
+	handler     http.Handler
+	handlerLock sync.RWMutex
+
+	// connContext is the ConnContext of the http.Server before the server
+	// first started, which the one installed by Serve calls. connContextSaved
+	// reports whether it has been saved.
+	connContext      connContextHook
+	connContextSaved bool
+
+	// drained counts the connections that finished while draining, and
+	// killed is set once the remaining connections have been forcefully
+	// closed, and softPhase while draining before the SoftTimeout expires.
+	// They must only be accessed atomically.
+	drained   int32
+	killed    int32
+	softPhase int32
+
+	// open counts the connections open now, peak the most that were open
+	// at once and forced those forcefully closed by the shutdown, for
+	// Stats. They must only be accessed atomically.
+	open   int32
+	peak   int32
+	forced int32
+
+	// state is the stage of the server's lifecycle. It must only be
+	// accessed atomically.
+	state int32
+
+	// shuttingDown is set to 1 once shutdown has been initiated, which may
+	// be a GraceWindow before draining. It must only be accessed atomically.
+	shuttingDown int32
+
+	// inFlight counts the requests being handled by CountingHandler. It
+	// must only be accessed atomically.
+	inFlight int32
+
+	// requestsDrained is set once no request is in flight while draining
+	// with DrainRequests, so that connections are closed as soon as they
+	// are idle. It must only be accessed atomically.
+	requestsDrained int32
+
+	// stopErr is the result of the last shutdown, protected by chanLock.
+	stopErr error
+
+	// listener is the listener passed to Serve, protected by chanLock.
+	listener net.Listener
+
+	// servedTLS is the TLS config of the last TLS listener created for the
+	// server. It is protected by chanLock.
+	servedTLS *tls.Config
+
+	// rebinder lets Rebind replace the listener, protected by chanLock.
+	rebinder *rebindListener
+
+	// tasks are the tasks started with Track and Go.
+	tasks taskGroup
+
+	// drainWaiters wait for the DrainWaiters added with AddDrainWaiter
+	// until their argument is closed. Protected by stopLock.
+	drainWaiters []func(stop <-chan struct{}) error
+
+	// resumed is closed by Resume while the server is paused, and nil
+	// otherwise. Protected by chanLock.
+	resumed chan struct{}
+
+	// pauser is the pauseListener of the listener being served, which
+	// Pause wakes up. Protected by chanLock.
+	pauser *pauseListener
+}
+
+// The stages of a server's lifecycle.
+const (
+	stateNew int32 = iota
+	stateRunning
+	stateDraining
+	stateStopped
+)
 
-	// idleConnections holds all idle connections managed by graceful
-	idleConnections map[net.Conn]struct{}
+// The timeouts set by ApplyTimeouts where the http.Server has none.
+const (
+	DefaultReadHeaderTimeout = 10 * time.Second
+	DefaultIdleTimeout       = 2 * time.Minute
+)
+
+// ErrAlreadyRunning is returned by Serve if the server has already been
+// started. A Server can only be served once.
+var ErrAlreadyRunning = errors.New("graceful: server has already been started")
+
+// ErrNotRunning is returned by Shutdown if the server has not been started,
+// and by Rebind if it is not serving.
+var ErrNotRunning = errors.New("graceful: server is not running")
+
+// ErrTimedOut is wrapped by every *TimeoutError, so that callers can check
+// whether a shutdown timed out with errors.Is(err, ErrTimedOut).
+var ErrTimedOut = errors.New("graceful: timeout expired")
+
+// ShutdownStats describes a completed shutdown.
+type ShutdownStats struct {
+	// Duration is how long it took from closing the listener until all
+	// connections were finished or forcefully closed.
+	Duration time.Duration
+
+	// ForcedConnections is the number of connections that were forcefully
+	// closed when the timeout expired.
+	ForcedConnections int
+
+	// ForcedAddrs holds the remote addresses of those connections.
+	ForcedAddrs []net.Addr
+
+	// InitiateDuration is how long it took from shutdown being initiated,
+	// e.g. by a signal, until the listener was closed, which includes
+	// BeforeShutdown and the GraceWindow. It is zero after an immediate
+	// shutdown.
+	InitiateDuration time.Duration
+
+	// DrainDuration is how long the connections drained, from closing the
+	// listener until they were finished or the timeout expired.
+	DrainDuration time.Duration
+
+	// ForceCloseDuration is how long it took to forcefully close the
+	// connections still open when the timeout expired.
+	ForceCloseDuration time.Duration
+
+	// CleanConnections is the number of connections that finished on their
+	// own after the listener was closed.
+	CleanConnections int
+
+	// ServedConnections and PeakConnections are the Served and Peak
+	// counts of Stats at the end of the shutdown.
+	ServedConnections int64
+	PeakConnections   int
+}
+
+// TimeoutError is returned by StopWithResult and Shutdown when the timeout
+// expired before all connections were closed and all tasks were finished.
+// It wraps ErrTimedOut, and can be retrieved with errors.As.
+type TimeoutError struct {
+	// Conns is the number of connections that were forcefully closed.
+	Conns int
+
+	// Addrs holds the remote addresses of those connections, as they were
+	// when the timeout expired.
+	Addrs []net.Addr
+
+	// Tasks is the number of tasks started with Track or Go that were
+	// still running. They are not stopped.
+	Tasks int
+}
+
+func (e *TimeoutError) Error() string {
+	if e.Tasks > 0 {
+		return fmt.Sprintf("graceful: timeout expired, %d connection(s) forcefully closed, %d task(s) still running", e.Conns, e.Tasks)
+	}
+	return fmt.Sprintf("graceful: timeout expired, %d connection(s) forcefully closed", e.Conns)
+}
+
+// Unwrap returns ErrTimedOut.
+func (e *TimeoutError) Unwrap() error { return ErrTimedOut }
+
+// BindError is returned when the server's address cannot be listened on.
+type BindError struct {
+	// Addr is the address that could not be bound.
+	Addr string
+
+	// Err is the underlying error, usually a *net.OpError.
+	Err error
+}
+
+func (e *BindError) Error() string {
+	switch {
+	case e.InUse():
+		return fmt.Sprintf("graceful: cannot listen on %s: address already in use", e.Addr)
+	case e.Denied():
+		return fmt.Sprintf("graceful: cannot listen on %s: permission denied (ports below 1024 usually need root or CAP_NET_BIND_SERVICE)", e.Addr)
+	}
+	return fmt.Sprintf("graceful: cannot listen on %s: %s", e.Addr, e.Err)
+}
+
+// InUse reports whether the address is already in use by another socket.
+func (e *BindError) InUse() bool { return e.errno() == syscall.EADDRINUSE }
+
+// Denied reports whether the process lacks the permission to bind the
+// address, as is the case for privileged ports.
+func (e *BindError) Denied() bool {
+	errno := e.errno()
+	return errno == syscall.EACCES || errno == syscall.EPERM
+}
+
+func (e *BindError) errno() syscall.Errno {
+	err := e.Err
+	if oe, ok := err.(*net.OpError); ok {
+		err = oe.Err
+	}
+	if se, ok := err.(*os.SyscallError); ok {
+		err = se.Err
+	}
+	errno, _ := err.(syscall.Errno)
+	return errno
 }
 
 // Run serves the http.Handler with graceful shutdown enabled.
@@ -101,9 +734,9 @@ func Run(addr string, timeout time.Duration, n http.Handler) {
 		// Logger:       DefaultLogger(),
 	}
 
-	if err := srv.ListenAndServe(); err != nil {
+	if err := srv.ListenAndServe(); err != nil && err != ErrServerClosed {
 		if opErr, ok := err.(*net.OpError); !ok || (ok && opErr.Op != "accept") {
-			srv.logf("%s", err)
+			DefaultLogger().Printf("%s", err)
 			os.Exit(1)
 		}
 	}
@@ -113,7 +746,8 @@ func Run(addr string, timeout time.Duration, n http.Handler) {
 // RunWithErr is an alternative version of Run function which can return error.
 //
 // Unlike Run this version will not exit the program if an error is encountered but will
-// return it instead.
+// return it instead. It listens on addr, handles SIGINT and SIGTERM, and blocks until
+// graceful shutdown has completed, returning nil on a clean shutdown.
 func RunWithErr(addr string, timeout time.Duration, n http.Handler) error {
 	srv := &Server{
 		Timeout:      timeout,
@@ -122,7 +756,10 @@ func RunWithErr(addr string, timeout time.Duration, n http.Handler) error {
 		Logger:       DefaultLogger(),
 	}
 
-	return srv.ListenAndServe()
+	if err := srv.ListenAndServe(); err != ErrServerClosed {
+		return err
+	}
+	return nil
 }
 
 // ListenAndServe is equivalent to http.Server.ListenAndServe with graceful shutdown enabled.
@@ -135,13 +772,21 @@ func ListenAndServe(server *http.Server, timeout time.Duration) error {
 }
 
 // ListenAndServe is equivalent to http.Server.ListenAndServe with graceful shutdown enabled.
+//
+// If Addr has the form "unix:/path/to/socket", the server listens on a Unix
+// domain socket at that path instead of TCP. A stale socket file left at the
+// path is removed first, and the socket file is removed again when the
+// listener is closed on shutdown.
+//
+// If the address cannot be listened on, ListenAndServe returns a
+// *BindError right away; see also Preflight.
 func (srv *Server) ListenAndServe() error {
 	// Create the listener so we can control their lifetime
 	addr := srv.Addr
 	if addr == "" {
 		addr = ":http"
 	}
-	l, err := net.Listen("tcp", addr)
+	l, err := srv.listen(addr, nil)
 	if err != nil {
 		return err
 	}
@@ -149,6 +794,29 @@ func (srv *Server) ListenAndServe() error {
 	return srv.Serve(l)
 }
 
+// Preflight checks that the server's address can be listened on, by
+// binding it and closing the listener again, so that a port which is
+// taken or privileged is reported before committing to serve. The error
+// is a *BindError. If the process was started by Restart and inherited a
+// listener on the address, it is already bound and Preflight returns nil.
+//
+// Like any such check, it cannot rule out the address being taken
+// between Preflight and ListenAndServe.
+func (srv *Server) Preflight() error {
+	addr := srv.Addr
+	if addr == "" {
+		addr = ":http"
+	}
+	if inherits(addr) {
+		return nil
+	}
+	l, err := srv.listen(addr, nil)
+	if err != nil {
+		return err
+	}
+	return l.Close()
+}
+
 // ListenAndServeTLS is equivalent to http.Server.ListenAndServeTLS with graceful shutdown enabled.
 //
 // timeout is the duration to wait until killing active requests and stopping the server.
@@ -161,34 +829,76 @@ func ListenAndServeTLS(server *http.Server, certFile, keyFile string, timeout ti
 // ListenTLS is a convenience method that creates an https listener using the
 // provided cert and key files. Use this method if you need access to the
 // listener object directly. When ready, pass it to the Serve method.
+//
+// As with http.Server.ListenAndServeTLS, certFile and keyFile may be left
+// empty if the Server's TLSConfig already provides a certificate.
 func (srv *Server) ListenTLS(certFile, keyFile string) (net.Listener, error) {
+	return srv.listenTLS(certFile, keyFile, nil)
+}
+
+// listenTLS is ListenTLS, with BindRetry stopped once cancel is closed.
+func (srv *Server) listenTLS(certFile, keyFile string, cancel <-chan struct{}) (net.Listener, error) {
 	// Create the listener ourselves so we can control its lifetime
 	addr := srv.Addr
 	if addr == "" {
 		addr = ":https"
 	}
 
-	config := &tls.Config{}
-	if srv.TLSConfig != nil {
-		*config = *srv.TLSConfig
+	config, err := srv.tlsConfig(certFile, keyFile)
+	if err != nil {
+		return nil, err
 	}
 
-	var err error
-	config.Certificates = make([]tls.Certificate, 1)
-	config.Certificates[0], err = tls.LoadX509KeyPair(certFile, keyFile)
+	conn, err := srv.listen(addr, cancel)
 	if err != nil {
 		return nil, err
 	}
 
-	conn, err := net.Listen("tcp", addr)
+	srv.TLSConfig = config
+
+	return srv.newTLSListener(conn, config), nil
+}
+
+// ServeTLS is equivalent to http.Server.ServeTLS with graceful shutdown
+// enabled. It serves HTTPS on l, which must be a plain listener, using a
+// copy of the Server's TLSConfig, so callbacks such as GetCertificate and
+// GetConfigForClient can pick the certificate by SNI. Configs returned by
+// GetConfigForClient must list "h2" in NextProtos themselves to offer
+// HTTP/2. Handshakes happen on connections that are already tracked, so
+// connections still in their handshake are drained like any other.
+//
+// As with ListenTLS, certFile and keyFile may be left empty if the
+// TLSConfig already provides a certificate.
+func (srv *Server) ServeTLS(l net.Listener, certFile, keyFile string) error {
+	config, err := srv.tlsConfig(certFile, keyFile)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	srv.TLSConfig = config
 
-	tlsListener := tls.NewListener(conn, config)
-	return tlsListener, nil
+	return srv.Serve(srv.newTLSListener(l, config))
+}
+
+// tlsConfig returns a copy of the Server's TLSConfig, loading the
+// certificate from certFile and keyFile if they are given or if the config
+// has no other way to find a certificate, and advertising HTTP/2.
+func (srv *Server) tlsConfig(certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if srv.TLSConfig != nil {
+		config = cloneTLSConfig(srv.TLSConfig)
+	}
+
+	if !hasCertificate(config) || certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	srv.enableHTTP2(config)
+	return config, nil
 }
 
 // ListenAndServeTLS is equivalent to http.Server.ListenAndServeTLS with graceful shutdown enabled.
@@ -209,15 +919,29 @@ func (srv *Server) ListenAndServeTLSConfig(config *tls.Config) error {
 		addr = ":https"
 	}
 
-	conn, err := net.Listen("tcp", addr)
+	conn, err := srv.listen(addr, nil)
 	if err != nil {
 		return err
 	}
 
+	srv.enableHTTP2(config)
 	srv.TLSConfig = config
 
-	tlsListener := tls.NewListener(conn, config)
-	return srv.Serve(tlsListener)
+	return srv.Serve(srv.newTLSListener(conn, config))
+}
+
+// newTLSListener returns a TLS listener on l, and records config as the
+// one being served for SetTLSTicketKeys. With ProxyProtocol, the PROXY
+// protocol header is read from the connections before the TLS handshake.
+func (srv *Server) newTLSListener(l net.Listener, config *tls.Config) net.Listener {
+	inner := l
+	if srv.ProxyProtocol {
+		inner = proxyListener{l}
+	}
+	srv.chanLock.Lock()
+	srv.servedTLS = config
+	srv.chanLock.Unlock()
+	return tlsListener{tls.NewListener(inner, config), l}
 }
 
 // Serve is equivalent to http.Server.Serve with graceful shutdown enabled.
@@ -230,7 +954,62 @@ func Serve(server *http.Server, l net.Listener, timeout time.Duration) error {
 }
 
 // Serve is equivalent to http.Server.Serve with graceful shutdown enabled.
+//
+// Like http.Server.Serve, it returns ErrServerClosed once the server has been
+// shut down cleanly, or the error encountered while closing the listener, so
+// that only genuine failures need to be handled. It does not report whether
+// connections had to be forcefully closed; use StopWithResult or TimedOut for
+// that.
+//
+// The listener need not be a TCP or Unix socket: any net.Listener, such as
+// an in-memory one, is served and drained in the same way. Only the
+// features that need a socket are unavailable: TCPKeepAlive has no effect,
+// and ListenerFile and Restart fail.
 func (srv *Server) Serve(listener net.Listener) error {
+	if !srv.start(listener) {
+		return ErrAlreadyRunning
+	}
+
+	if !srv.NoDefaultTimeouts {
+		srv.ApplyTimeouts()
+	}
+
+	srv.installHandler()
+	if srv.redirectPort != "" {
+		srv.Handler = redirectHandler(srv.Handler, srv.redirectPort)
+	}
+	if srv.MaxBodyBytes > 0 {
+		srv.Handler = maxBodyHandler(srv.Handler, srv.MaxBodyBytes)
+	}
+	// A worker is held until the handler returns, even once the request
+	// has timed out.
+	if srv.MaxWorkers > 0 {
+		srv.Handler = srv.workerHandler(srv.Handler)
+	}
+	if srv.RequestTimeout > 0 {
+		srv.Handler = http.TimeoutHandler(srv.Handler, srv.RequestTimeout, "")
+	}
+	srv.Handler = srv.withDrainInfo(srv.Handler)
+	if srv.drainPipelined() {
+		srv.Handler = srv.DrainMiddleware(srv.Handler)
+	} else if srv.keepsConns() {
+		srv.Handler = srv.closeWhenDraining(srv.Handler)
+	}
+	if srv.ConnCloseTimeout > 0 {
+		srv.Handler = srv.connCloseHandler(srv.Handler)
+	}
+	if srv.DrainExemptHeader != "" {
+		srv.Handler = srv.drainExemptHandler(srv.Handler)
+	}
+
+	rl := &rebindListener{l: listener}
+	pl := newPauseListener(rl, srv)
+	srv.chanLock.Lock()
+	srv.rebinder = rl
+	srv.pauser = pl
+	srv.chanLock.Unlock()
+	listener = newBackoffListener(pl, srv.AcceptBackoffMax, srv.logf)
+	listener = srv.warmup(listener)
 
 	if srv.ListenLimit != 0 {
 		listener = LimitListener(listener, srv.ListenLimit)
@@ -240,51 +1019,116 @@ func (srv *Server) Serve(listener net.Listener) error {
 		listener = keepAliveListener{listener, srv.TCPKeepAlive}
 	}
 
-	// Make our stopchan
-	srv.StopChan()
+	if srv.ProxyProtocol && !readsProxyHeader(srv.listener) {
+		listener = proxyListener{listener}
+	}
 
-	// Track connection state
-	add := make(chan net.Conn)
-	idle := make(chan net.Conn)
-	active := make(chan net.Conn)
-	remove := make(chan net.Conn)
+	if srv.OnAccept != nil {
+		listener = newAcceptHookListener(listener, srv)
+	}
 
-	srv.Server.ConnState = func(conn net.Conn, state http.ConnState) {
-		switch state {
-		case http.StateNew:
-			add <- conn
-		case http.StateActive:
-			active <- conn
-		case http.StateIdle:
-			idle <- conn
-		case http.StateClosed, http.StateHijacked:
-			remove <- conn
-		}
+	return srv.serve(listener, srv.Server.Serve)
+}
 
-		srv.stopLock.Lock()
-		defer srv.stopLock.Unlock()
+// warmup limits the accept rate of listener during the warmup, if any.
+func (srv *Server) warmup(listener net.Listener) net.Listener {
+	if srv.WarmupRate <= 0 || srv.WarmupDuration <= 0 {
+		return listener
+	}
+	return newWarmupListener(listener, srv, srv.WarmupRate, srv.WarmupDuration)
+}
 
-		if srv.ConnState != nil {
-			srv.ConnState(conn, state)
-		}
+// start moves the server from new to running and records listener as the
+// one it serves on. If the server was already started, it closes listener
+// and returns false.
+func (srv *Server) start(listener net.Listener) bool {
+	if !atomic.CompareAndSwapInt32(&srv.state, stateNew, stateRunning) {
+		listener.Close()
+		return false
 	}
 
-	// Manage open connections
-	shutdown := make(chan chan struct{})
-	kill := make(chan struct{})
-	go srv.manageConnections(add, idle, active, remove, shutdown, kill)
+	srv.chanLock.Lock()
+	srv.listener = listener
+	srv.chanLock.Unlock()
+	return true
+}
+
+// serve serves listener with serveConns, which tracks its connections
+// through srv.Server.ConnState and returns once listener is closed, and
+// then shuts down gracefully.
+func (srv *Server) serve(listener net.Listener, serveConns func(net.Listener) error) error {
+	// Make our stopchan
+	srv.StopChan()
+
+	// Track connection state
+	tracker := srv.ConnTracker
+	if tracker == nil {
+		tracker = newConnTracker()
+	}
+	wake := make(chan struct{}, 1)
+
+	srv.chanLock.Lock()
+	srv.tracker = tracker
+	srv.drainWake = wake
+	srv.chanLock.Unlock()
+
+	srv.Server.ConnState = srv.connStateHook(tracker, wake)
+	srv.installConnContext()
 
 	interrupt := srv.interruptChan()
+	// abort is closed on an immediate shutdown
+	var abort <-chan struct{}
+	done := make(chan struct{})
+	defer close(done)
+	if srv.ShutdownFile != "" {
+		go srv.watchShutdownFile(done)
+	}
+	if srv.MemoryLimitBytes > 0 {
+		go srv.watchMemory(done)
+	}
 	// Set up the interrupt handler
 	if !srv.NoSignalHandling {
-		signal.Notify(interrupt, syscall.SIGINT, syscall.SIGTERM)
+		signals := srv.Signals
+		if len(signals) == 0 {
+			signals = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+		}
+		signal.Notify(interrupt, signals...)
+		defer signal.Stop(interrupt)
+
+		if srv.RestartOnHangup {
+			go srv.handleHangup(done)
+		}
+		if len(srv.ImmediateSignals) > 0 {
+			abort = srv.handleImmediate(done)
+		}
 	}
 	quitting := make(chan struct{})
-	go srv.handleInterrupt(interrupt, quitting, listener)
+	closeErr := make(chan error, 1)
+	go srv.handleInterrupt(interrupt, abort, quitting, closeErr, listener)
+
+	if srv.OnListen != nil {
+		srv.onListen(listener.Addr())
+	}
+	srv.emit(EventListen, listener.Addr().String())
+
+	// A process started by Restart lets its parent stop now.
+	if err := srv.NotifyReady(); err != nil {
+		srv.logf("[ERROR] %s", err)
+	}
+	if srv.SdNotify {
+		srv.sdNotify("READY=1")
+	}
+	srv.chanLock.Lock()
+	if srv.readyChan == nil {
+		srv.readyChan = make(chan struct{})
+	}
+	close(srv.readyChan)
+	srv.chanLock.Unlock()
 
 	// Serve with graceful listener.
 	// Execution blocks here until listener.Close() is called, above.
-	err := srv.Server.Serve(listener)
+	err := serveConns(listener)
+	closed := false
 	if err != nil {
 		// If the underlying listening is closed, Serve returns an error
 		// complaining about listening on a closed socket. This is expected, so
@@ -292,16 +1136,101 @@ func (srv *Server) Serve(listener net.Listener) error {
 		// socket.
 		select {
 		case <-quitting:
-			err = nil
+			// Errors from closing the listener are still reported.
+			err = <-closeErr
+			closed = true
 		default:
 		}
 	}
 
-	srv.shutdown(shutdown, kill)
+	var stats ShutdownStats
+	start := srv.clock().Now()
+	stopErr := srv.shutdown(abort, &stats)
+	if terr, ok := stopErr.(*TimeoutError); ok {
+		atomic.StoreInt32(&srv.forced, int32(terr.Conns))
+	}
+	if srv.OnShutdownComplete != nil {
+		stats.Duration = srv.clock().Now().Sub(start)
+		stats.CleanConnections = int(atomic.LoadInt32(&srv.drained))
+		conns := srv.Stats()
+		stats.ServedConnections = conns.Served
+		stats.PeakConnections = conns.Peak
+		srv.stopLock.Lock()
+		if !srv.initiated.IsZero() {
+			stats.InitiateDuration = start.Sub(srv.initiated)
+		}
+		srv.stopLock.Unlock()
+		if terr, ok := stopErr.(*TimeoutError); ok {
+			stats.ForcedConnections = terr.Conns
+			stats.ForcedAddrs = terr.Addrs
+		}
+		srv.OnShutdownComplete(stats)
+	}
+	if stopErr == nil {
+		stopErr = err
+	}
+	detail := ""
+	if stopErr != nil {
+		detail = stopErr.Error()
+	}
+	srv.emit(EventStopped, detail)
+	srv.closeStopChan(stopErr)
 
+	if closed && err == nil {
+		return ErrServerClosed
+	}
 	return err
 }
 
+// ApplyTimeouts sets the ReadHeaderTimeout and IdleTimeout of the embedded
+// http.Server to DefaultReadHeaderTimeout and DefaultIdleTimeout, unless
+// they are already set. Serve calls it unless NoDefaultTimeouts is set. It
+// requires Go 1.8 and does nothing on older versions.
+//
+// A connection that has been accepted but has not sent a complete request
+// header holds up shutdown like an active one, so a ReadHeaderTimeout well
+// below Timeout lets such connections go before they have to be forcefully
+// closed. Idle keep-alive connections are closed as soon as shutdown starts,
+// whatever the IdleTimeout. ReadTimeout and WriteTimeout are left alone, as
+// they also cut short legitimately slow uploads and downloads; set them, or
+// RequestTimeout, if slow clients must not be able to outlast Timeout.
+func (srv *Server) ApplyTimeouts() {
+	srv.applyTimeouts()
+}
+
+// ServeMulti is equivalent to Serve, but accepts connections on all of the
+// given listeners at once. The connections from all listeners are drained
+// together within a single Timeout, and all listeners are closed on shutdown.
+func (srv *Server) ServeMulti(listeners ...net.Listener) error {
+	if len(listeners) == 0 {
+		return errNoListeners
+	}
+	if srv.ProxyProtocol {
+		// Each listener reads the header of its own connections, so that
+		// TLS listeners read it before the handshake.
+		proxied := make([]net.Listener, len(listeners))
+		for i, l := range listeners {
+			if !readsProxyHeader(l) {
+				l = proxyListener{l}
+			}
+			proxied[i] = l
+		}
+		listeners = proxied
+	}
+	return srv.Serve(newMultiListener(listeners))
+}
+
+// readsProxyHeader reports whether l reads the PROXY header of its
+// connections itself: TLS listeners from ListenTLS read it before the
+// handshake, and so do the listeners of ServeMulti, one by one.
+func readsProxyHeader(l net.Listener) bool {
+	switch l.(type) {
+	case tlsListener, *multiListener:
+		return true
+	}
+	return false
+}
+
 // Stop instructs the type to halt operations and close
 // the stop channel when it is finished.
 //
@@ -309,13 +1238,97 @@ func (srv *Server) Serve(listener net.Listener) error {
 // down the server. The timeout value passed here will override the
 // timeout given when constructing the server, as this is an explicit
 // command to stop the server.
+//
+// Stop never blocks and is safe to call concurrently. Once a stop is
+// pending or the server is already draining, further calls do nothing.
 func (srv *Server) Stop(timeout time.Duration) {
+	srv.requestStop(stopSignal{timeout: timeout})
+}
+
+// requestStop sends sig on the interrupt channel for Stop and Shutdown,
+// unless a stop is already pending or the server is draining.
+func (srv *Server) requestStop(sig stopSignal) {
 	srv.stopLock.Lock()
 	defer srv.stopLock.Unlock()
 
-	srv.Timeout = timeout
-	interrupt := srv.interruptChan()
-	interrupt <- syscall.SIGINT
+	if atomic.LoadInt32(&srv.state) >= stateDraining {
+		return
+	}
+
+	select {
+	case srv.interruptChan() <- sig:
+	default:
+	}
+}
+
+// TriggerShutdown initiates shutdown as if SIGTERM had been received, even
+// if NoSignalHandling is set, and returns the stop channel. Unlike Stop, it
+// leaves the Timeout alone and goes through BeforeShutdown like a signal
+// would. It may be called before Serve, in which case shutdown starts as
+// soon as the server is serving, so tests can write
+//
+//	stop := srv.TriggerShutdown()
+//	go srv.Serve(l)
+//	<-stop
+//
+// without sleeping. Like a signal, it is dropped if another one is still
+// waiting to be handled.
+func (srv *Server) TriggerShutdown() <-chan struct{} {
+	stop := srv.StopChan()
+	select {
+	case srv.interruptChan() <- syscall.SIGTERM:
+	default:
+	}
+	return stop
+}
+
+// Interrupt returns the channel on which the server receives the signals it
+// handles, so that shutdown can be triggered programmatically or from a
+// custom signal source exactly as by the operating system: a signal in
+// ImmediateSignals stops the server at once, and any other initiates a
+// graceful shutdown. Signals are received even if NoSignalHandling is set.
+// The channel holds a single pending signal, so a send blocks while one is
+// waiting to be handled. It may be called before Serve.
+func (srv *Server) Interrupt() chan<- os.Signal {
+	return srv.interruptChan()
+}
+
+// stopSignal is sent on the interrupt channel by Stop and Shutdown. From
+// Stop, it carries the timeout to use for the shutdown, so the Timeout is
+// only changed by the goroutine handling interrupts. From Shutdown, it
+// carries the done channel of its context instead, on which the remaining
+// connections are forcefully closed in place of the Timeout, and the
+// deadline of the context, if any. Neither is applied if BeforeShutdown
+// cancels the shutdown.
+type stopSignal struct {
+	timeout  time.Duration
+	cancel   <-chan struct{}
+	deadline time.Time
+}
+
+func (s stopSignal) String() string { return "stop" }
+func (s stopSignal) Signal()        {}
+
+// contextSignal is sent on the interrupt channel by ServeWithContext when
+// its context is done. Unlike the context of Shutdown, it leaves the
+// Timeout to bound the drain.
+type contextSignal struct{}
+
+func (s contextSignal) String() string { return "context done" }
+func (s contextSignal) Signal()        {}
+
+// StopWithResult is like Stop, but blocks until the server has stopped.
+// It returns a *TimeoutError if connections had to be forcefully closed
+// when the timeout expired, otherwise any error encountered while closing
+// the listener.
+func (srv *Server) StopWithResult(timeout time.Duration) error {
+	stop := srv.StopChan()
+	srv.Stop(timeout)
+	<-stop
+
+	srv.chanLock.RLock()
+	defer srv.chanLock.RUnlock()
+	return srv.stopErr
 }
 
 // StopChan gets the stop channel which will block until
@@ -331,60 +1344,287 @@ func (srv *Server) StopChan() <-chan struct{} {
 	return srv.stopChan
 }
 
+// Ready gets a channel which is closed once the server is serving, so that
+// connections made afterwards are accepted, including when the listener is
+// created by ListenAndServe or one of its variants. It is never closed if
+// the server fails to start, so callers should also watch for Serve
+// returning. Callers should never close the ready channel.
+func (srv *Server) Ready() <-chan struct{} {
+	srv.chanLock.Lock()
+	defer srv.chanLock.Unlock()
+
+	if srv.readyChan == nil {
+		srv.readyChan = make(chan struct{})
+	}
+	return srv.readyChan
+}
+
+// drainStarted gets a channel which is closed once draining begins.
+func (srv *Server) drainStarted() <-chan struct{} {
+	srv.chanLock.Lock()
+	defer srv.chanLock.Unlock()
+
+	if srv.drainingChan == nil {
+		srv.drainingChan = make(chan struct{})
+	}
+	return srv.drainingChan
+}
+
+// Done gets a channel which receives the result of the shutdown once the
+// server has stopped: nil if every connection finished, or a
+// *TimeoutError (which wraps ErrTimedOut) if some had to be forcefully
+// closed. The result is delivered exactly once, so only one caller
+// should receive from the channel; use StopChan to broadcast.
+func (srv *Server) Done() <-chan error {
+	srv.chanLock.Lock()
+	defer srv.chanLock.Unlock()
+
+	if srv.doneChan == nil {
+		srv.doneChan = make(chan error, 1)
+	}
+	return srv.doneChan
+}
+
+// TimedOut gets a channel which is closed if the timeout expired during
+// shutdown and the remaining connections were forcefully closed. It is
+// closed before the stop channel, so once the stop channel is closed,
+// callers can check whether the shutdown was clean without blocking.
+// Callers should never close the timed out channel.
+func (srv *Server) TimedOut() <-chan struct{} {
+	srv.chanLock.Lock()
+	defer srv.chanLock.Unlock()
+
+	if srv.timedOutChan == nil {
+		srv.timedOutChan = make(chan struct{})
+	}
+	return srv.timedOutChan
+}
+
+// ReleaseHijacked tells graceful that the handler which hijacked conn is
+// done with it, so that it no longer holds up shutdown. It only needs to be
+// called when OnHijackedShutdown is set.
+func (srv *Server) ReleaseHijacked(conn net.Conn) {
+	srv.chanLock.RLock()
+	tracker, wake := srv.tracker, srv.drainWake
+	srv.chanLock.RUnlock()
+
+	if tracker == nil || srv.OnHijackedShutdown == nil {
+		return
+	}
+	srv.trackConn(tracker, wake, conn, http.StateClosed)
+}
+
+// ListenerAddr returns the address of the listener the server is serving
+// on, or nil if it has not started serving yet. With an Addr such as ":0",
+// it reports the port that was actually chosen.
+func (srv *Server) ListenerAddr() net.Addr {
+	srv.chanLock.RLock()
+	defer srv.chanLock.RUnlock()
+
+	if srv.listener == nil {
+		return nil
+	}
+	return srv.listener.Addr()
+}
+
+// IsRunning reports whether the server has been started and is accepting
+// connections.
+func (srv *Server) IsRunning() bool {
+	return atomic.LoadInt32(&srv.state) == stateRunning
+}
+
+// Draining reports whether the server has stopped accepting connections
+// and is waiting for outstanding requests to finish.
+func (srv *Server) Draining() bool {
+	return atomic.LoadInt32(&srv.state) == stateDraining
+}
+
+// Stopped reports whether the server has shut down completely.
+func (srv *Server) Stopped() bool {
+	return atomic.LoadInt32(&srv.state) == stateStopped
+}
+
+// ActiveConnections returns the number of connections currently managed by
+// graceful, whether active or idle. It is safe to call concurrently, e.g.
+// from a request handler.
+func (srv *Server) ActiveConnections() int {
+	srv.chanLock.RLock()
+	tracker := srv.tracker
+	srv.chanLock.RUnlock()
+
+	if tracker == nil {
+		return 0
+	}
+	return tracker.Len()
+}
+
 // DefaultLogger returns the logger used by Run, RunWithErr, ListenAndServe, ListenAndServeTLS and Serve.
 // The logger outputs to STDERR by default.
 func DefaultLogger() *log.Logger {
 	return log.New(os.Stderr, "[graceful] ", 0)
 }
 
-func (srv *Server) manageConnections(add, idle, active, remove chan net.Conn, shutdown chan chan struct{}, kill chan struct{}) {
-	var done chan struct{}
-	srv.connections = map[net.Conn]struct{}{}
-	srv.idleConnections = map[net.Conn]struct{}{}
+// unixPrefix marks an address as the path of a Unix domain socket.
+const unixPrefix = "unix:"
+
+// listen creates a listener for addr. Addresses starting with unixPrefix
+// are Unix domain sockets; everything else is TCP, over both IP versions
+// if DualStack is set. If the process was
+// started by Restart, the inherited listener is used instead when it
+// listens on addr. Closing cancel, which may be nil, stops any BindRetry.
+func (srv *Server) listen(addr string, cancel <-chan struct{}) (net.Listener, error) {
+	if l, err := inheritedListener(addr); l != nil || err != nil {
+		return l, err
+	}
+
+	if !strings.HasPrefix(addr, unixPrefix) {
+		if srv.DualStack {
+			return srv.listenDualStack(addr, cancel)
+		}
+		return srv.bind("tcp", addr, cancel)
+	}
+
+	path := strings.TrimPrefix(addr, unixPrefix)
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("graceful: %s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// A UnixListener removes its socket file when it is closed.
+	return srv.bind("unix", path, cancel)
+}
+
+// bind listens on addr, with SO_REUSEPORT for TCP if ReusePort is set,
+// retrying for up to the BindRetry while addr is in use, or until cancel
+// is closed. It returns a *BindError if it cannot.
+func (srv *Server) bind(network, addr string, cancel <-chan struct{}) (net.Listener, error) {
+	clock := srv.clock()
+	giveUp := clock.Now().Add(srv.BindRetry)
+	var delay time.Duration
 	for {
+		var l net.Listener
+		var err error
+		if srv.ReusePort && strings.HasPrefix(network, "tcp") {
+			l, err = listenReusePort(network, addr)
+		} else {
+			l, err = net.Listen(network, addr)
+		}
+		if err == nil {
+			return l, nil
+		}
+
+		berr := &BindError{Addr: addr, Err: err}
+		left := giveUp.Sub(clock.Now())
+		if !berr.InUse() || left <= 0 {
+			return nil, berr
+		}
+		if delay == 0 {
+			delay = 5 * time.Millisecond
+		} else if delay *= 2; delay > time.Second {
+			delay = time.Second
+		}
+		if delay > left {
+			delay = left
+		}
+		srv.logf("%s; retrying in %s", berr, delay)
 		select {
-		case conn := <-add:
-			srv.connections[conn] = struct{}{}
-		case conn := <-idle:
-			srv.idleConnections[conn] = struct{}{}
-		case conn := <-active:
-			delete(srv.idleConnections, conn)
-		case conn := <-remove:
-			delete(srv.connections, conn)
-			delete(srv.idleConnections, conn)
-			if done != nil && len(srv.connections) == 0 {
-				done <- struct{}{}
-				return
-			}
-		case done = <-shutdown:
-			if len(srv.connections) == 0 && len(srv.idleConnections) == 0 {
-				done <- struct{}{}
-				return
-			}
-			// a shutdown request has been received. if we have open idle
-			// connections, we must close all of them now. this prevents idle
-			// connections from holding the server open while waiting for them to
-			// hit their idle timeout.
-			for k := range srv.idleConnections {
-				if err := k.Close(); err != nil {
-					srv.logf("[ERROR] %s", err)
-				}
-			}
-		case <-kill:
-			srv.stopLock.Lock()
-			defer srv.stopLock.Unlock()
-
-			srv.Server.ConnState = nil
-			for k := range srv.connections {
-				if err := k.Close(); err != nil {
-					srv.logf("[ERROR] %s", err)
-				}
-			}
-			return
+		case <-clock.After(delay):
+		case <-cancel:
+			return nil, berr
 		}
 	}
 }
 
+// connStateHook returns the http.Server.ConnState callback that tracks
+// connections in tracker and then calls the ConnState of srv, if any.
+func (srv *Server) connStateHook(tracker ConnTracker, wake chan struct{}) func(net.Conn, http.ConnState) {
+	return func(conn net.Conn, state http.ConnState) {
+		tracked := state
+		if state == http.StateHijacked && srv.OnHijackedShutdown == nil {
+			// graceful no longer manages the connection
+			tracked = http.StateClosed
+		}
+		srv.trackConn(tracker, wake, conn, tracked)
+
+		srv.stopLock.Lock()
+		defer srv.stopLock.Unlock()
+
+		if srv.ConnState != nil {
+			srv.ConnState(conn, state)
+		}
+	}
+}
+
+// trackConn records that conn moved to state in tracker. While draining,
+// it calls OnHijackedShutdown for hijacked connections, and signals wake
+// when a connection closes.
+func (srv *Server) trackConn(tracker ConnTracker, wake chan struct{}, conn net.Conn, state http.ConnState) {
+	if atomic.LoadInt32(&srv.killed) != 0 {
+		return
+	}
+	tracker.SetState(conn, state)
+	srv.countConn(state)
+	if state != http.StateActive {
+		srv.unextend(conn)
+		srv.clearPriority(conn)
+	}
+	if srv.SlowClientTimeout > 0 {
+		if state == http.StateNew {
+			srv.watchSlowClient(conn)
+		} else {
+			srv.stopSlowClient(conn)
+		}
+	}
+	if atomic.LoadInt32(&srv.state) < stateDraining {
+		return
+	}
+
+	if srv.drainPipelined() {
+		srv.stopIdleWait(conn)
+	}
+	switch state {
+	case http.StateIdle:
+		if atomic.LoadInt32(&srv.requestsDrained) != 0 {
+			// closeRemaining left it open to finish its response.
+			conn.Close()
+		} else if srv.drainPipelined() && !srv.NoCloseIdle && atomic.LoadInt32(&srv.softPhase) == 0 {
+			srv.closeWhenIdle(conn)
+		}
+	case http.StateHijacked:
+		srv.notifyHijacked(conn)
+	case http.StateClosed:
+		if !srv.wasCut(conn) {
+			atomic.AddInt32(&srv.drained, 1)
+		}
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// notifyHijacked calls OnHijackedShutdown for conn in its own goroutine,
+// unless it has already been called for it.
+func (srv *Server) notifyHijacked(conn net.Conn) {
+	srv.hijackLock.Lock()
+	defer srv.hijackLock.Unlock()
+
+	if srv.hijackNotified == nil {
+		srv.hijackNotified = map[net.Conn]struct{}{}
+	}
+	if _, ok := srv.hijackNotified[conn]; ok {
+		return
+	}
+	srv.hijackNotified[conn] = struct{}{}
+	go srv.OnHijackedShutdown(conn)
+}
+
 func (srv *Server) interruptChan() chan os.Signal {
 	srv.chanLock.Lock()
 	defer srv.chanLock.Unlock()
@@ -396,12 +1636,39 @@ func (srv *Server) interruptChan() chan os.Signal {
 	return srv.interrupt
 }
 
-func (srv *Server) handleInterrupt(interrupt chan os.Signal, quitting chan struct{}, listener net.Listener) {
-	for _ = range interrupt {
+func (srv *Server) handleInterrupt(interrupt chan os.Signal, abort <-chan struct{}, quitting chan struct{}, closeErr chan error, listener net.Listener) {
+	for {
+		var sig os.Signal
+		select {
+		case sig = <-interrupt:
+		case <-abort:
+			abort = nil
+			// If the listener is already closed, shutdown cuts the
+			// drain short by itself.
+			if !srv.Interrupted {
+				srv.Interrupted = true
+				srv.closeListener(quitting, closeErr, listener)
+			}
+			continue
+		}
+
 		if srv.Interrupted {
 			srv.logf("already shutting down")
 			continue
 		}
+		initiated := srv.clock().Now()
+		reason := ReasonSignal
+		var stop stopSignal
+		switch s := sig.(type) {
+		case stopSignal:
+			stop = s
+			reason = ReasonStop
+			if s.cancel != nil {
+				reason = ReasonContext
+			}
+		case contextSignal:
+			reason = ReasonContext
+		}
 		srv.logf("shutdown initiated")
 		srv.Interrupted = true
 		if srv.BeforeShutdown != nil {
@@ -411,18 +1678,127 @@ func (srv *Server) handleInterrupt(interrupt chan os.Signal, quitting chan struc
 			}
 		}
 
-		close(quitting)
-		srv.SetKeepAlivesEnabled(false)
-		if err := listener.Close(); err != nil {
-			srv.logf("[ERROR] %s", err)
+		// Only a shutdown that goes ahead applies the settings of a stop.
+		srv.stopLock.Lock()
+		srv.initiated = initiated
+		srv.reason = reason
+		if stop.cancel != nil {
+			srv.cancel = stop.cancel
+			if !stop.deadline.IsZero() {
+				srv.deadline = stop.deadline
+			}
+		} else if reason == ReasonStop {
+			srv.Timeout = stop.timeout
+			if srv.HardTimeout > 0 {
+				srv.HardTimeout = stop.timeout
+			}
 		}
-
+		srv.stopLock.Unlock()
+		atomic.StoreInt32(&srv.shuttingDown, 1)
 		if srv.ShutdownInitiated != nil {
-			srv.ShutdownInitiated()
+			srv.shutdownInitiated()
+		}
+		srv.emit(EventShutdown, reason)
+
+		if srv.GraceWindow > 0 {
+			select {
+			case <-srv.clock().After(srv.GraceWindow):
+			case <-abort:
+				abort = nil
+			}
 		}
+
+		srv.closeListener(quitting, closeErr, listener)
+	}
+}
+
+// closeListener stops the server from accepting connections, so that
+// it starts draining.
+func (srv *Server) closeListener(quitting chan struct{}, closeErr chan error, listener net.Listener) {
+	soft := srv.softTimeout() > 0
+	if soft {
+		atomic.StoreInt32(&srv.softPhase, 1)
+	}
+	atomic.StoreInt32(&srv.state, stateDraining)
+	close(quitting)
+	srv.chanLock.Lock()
+	if srv.drainingChan == nil {
+		srv.drainingChan = make(chan struct{})
+	}
+	close(srv.drainingChan)
+	srv.chanLock.Unlock()
+	srv.emit(EventDrainStart, "")
+	if srv.SdNotify {
+		srv.sdNotify("STOPPING=1")
+	}
+	if !soft && !srv.keepsConns() {
+		srv.SetKeepAlivesEnabled(false)
+	}
+	err := listener.Close()
+	if err != nil {
+		srv.logf("[ERROR] %s", err)
+	}
+	if !soft && !srv.keepsConns() {
+		srv.notifyShutdown()
+	}
+	closeErr <- err
+	if srv.OnListenerClosed != nil {
+		srv.listenerClosed()
 	}
 }
 
+// onListen calls OnListen, recovering from a panic in it.
+func (srv *Server) onListen(addr net.Addr) {
+	defer func() {
+		if r := recover(); r != nil {
+			srv.logf("[ERROR] OnListen panic: %v", r)
+		}
+	}()
+	srv.OnListen(addr)
+}
+
+// listenerClosed calls OnListenerClosed, recovering from a panic in it.
+func (srv *Server) listenerClosed() {
+	defer func() {
+		if r := recover(); r != nil {
+			srv.logf("[ERROR] OnListenerClosed panic: %v", r)
+		}
+	}()
+	srv.OnListenerClosed()
+}
+
+// handleImmediate listens for the ImmediateSignals until done is closed.
+// The returned channel is closed when one of them is received.
+func (srv *Server) handleImmediate(done chan struct{}) <-chan struct{} {
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, srv.ImmediateSignals...)
+	abort := make(chan struct{})
+	go func() {
+		// Keep catching the signals until the server has stopped, so a
+		// repeated signal cannot kill the process halfway through.
+		defer signal.Stop(quit)
+		select {
+		case sig := <-quit:
+			srv.logf("received %s, shutting down immediately", sig)
+			close(abort)
+			<-done
+		case <-done:
+		}
+	}()
+	return abort
+}
+
+// shutdownInitiated runs the ShutdownInitiated callback, recovering from
+// any panic so that it cannot prevent the server from shutting down.
+func (srv *Server) shutdownInitiated() {
+	defer func() {
+		if r := recover(); r != nil {
+			srv.logf("[ERROR] ShutdownInitiated panic: %v", r)
+		}
+	}()
+	srv.ShutdownInitiated()
+}
+
 func (srv *Server) logf(format string, args ...interface{}) {
 	if srv.LogFunc != nil {
 		srv.LogFunc(format, args...)
@@ -431,24 +1807,304 @@ func (srv *Server) logf(format string, args ...interface{}) {
 	}
 }
 
-func (srv *Server) shutdown(shutdown chan chan struct{}, kill chan struct{}) {
-	// Request done notification
-	done := make(chan struct{})
-	shutdown <- done
+// shutdown waits for all connections and tasks to finish, forcefully
+// closing the connections once the timeout expires or abort is closed.
+// It returns a *TimeoutError if it had to, or if tasks were left running,
+// and records the duration of the phases in stats.
+func (srv *Server) shutdown(abort <-chan struct{}, stats *ShutdownStats) error {
+	clock := srv.clock()
+	start := clock.Now()
+	srv.chanLock.RLock()
+	tracker, wake := srv.tracker, srv.drainWake
+	srv.chanLock.RUnlock()
 
-	if srv.Timeout > 0 {
+	srv.stopLock.Lock()
+	timeout := srv.Timeout
+	if srv.HardTimeout > 0 {
+		timeout = srv.HardTimeout
+	}
+	// Stop and Shutdown bound the drain themselves, with their timeout or
+	// context, in place of the scaled timeout.
+	cancel := srv.cancel
+	if srv.PerConnTimeout > 0 && srv.reason != ReasonStop && cancel == nil {
+		timeout = srv.scaledTimeout(tracker.Len())
+	}
+	if cancel != nil || srv.DrainForever {
+		timeout = 0
+	}
+	if timeout > 0 && srv.TimeoutJitter > 0 {
+		timeout += srv.jitter()
+	}
+	if timeout > 0 {
+		srv.deadline = start.Add(timeout)
+	}
+	srv.stopLock.Unlock()
+
+	srv.logf("draining %d connection(s)", tracker.Len())
+	stopWaiters := srv.startDrainWaiters()
+	defer close(stopWaiters)
+	var soft <-chan time.Time
+	if d := srv.softTimeout(); d > 0 {
+		soft = clock.After(d)
+	} else {
+		srv.askToClose(tracker)
+	}
+
+	interval := srv.DrainTickInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	var tick <-chan time.Time
+	if srv.OnDrainTick != nil || srv.eventsEnabled() {
+		tick = clock.After(interval)
+	}
+
+	expired := srv.drainTimeout(timeout)
+	var extension <-chan time.Time
+	var killed []net.Addr
+	kill := func(closeConns func(ConnTracker) []net.Addr) {
+		began := clock.Now()
+		killed = append(killed, closeConns(tracker)...)
+		stats.ForceCloseDuration += clock.Now().Sub(began)
+	}
+drain:
+	for tracker.Len() > 0 {
+		if srv.DrainRequests && atomic.LoadInt32(&srv.requestsDrained) == 0 && srv.InFlightRequests() == 0 {
+			srv.closeRemaining(tracker)
+		}
+		select {
+		case <-wake:
+		case <-soft:
+			soft = nil
+			atomic.StoreInt32(&srv.softPhase, 0)
+			if !srv.keepsConns() {
+				srv.SetKeepAlivesEnabled(false)
+				srv.notifyShutdown()
+			}
+			srv.askToClose(tracker)
+		case <-tick:
+			// The last connection may have closed meanwhile.
+			if n := tracker.Len(); n > 0 {
+				if srv.OnDrainTick != nil {
+					srv.OnDrainTick(n)
+				}
+				srv.emit(EventDrainTick, "")
+			}
+			tick = clock.After(interval)
+		case <-expired:
+			srv.emit(EventTimeout, "")
+			srv.profile()
+			if keep, d := srv.spared(tracker); len(keep) > 0 {
+				expired = nil
+				extension = clock.After(d)
+				kill(func(tracker ConnTracker) []net.Addr { return srv.killUnspared(tracker, keep) })
+				continue
+			}
+			kill(srv.killConnections)
+			break drain
+		case <-extension:
+			kill(srv.killConnections)
+			break drain
+		case <-abort:
+			kill(srv.killConnections)
+			break drain
+		case <-cancel:
+			kill(srv.killConnections)
+			break drain
+		}
+	}
+	stats.DrainDuration = clock.Now().Sub(start) - stats.ForceCloseDuration
+
+	if len(killed) == 0 {
+		// The tasks get what is left of the timeout.
+		var expired <-chan time.Time
+		if timeout > 0 {
+			expired = clock.After(timeout - clock.Now().Sub(start))
+		}
+		select {
+		case <-srv.tasks.wait():
+		case <-expired:
+		case <-abort:
+		case <-cancel:
+		}
+	}
+
+	tasks := srv.tasks.count()
+	if len(killed) == 0 && tasks == 0 {
+		return nil
+	}
+	if tasks > 0 {
+		srv.logf("timeout expired, %d task(s) still running", tasks)
+	}
+	srv.chanLock.Lock()
+	if srv.timedOutChan == nil {
+		srv.timedOutChan = make(chan struct{})
+	}
+	close(srv.timedOutChan)
+	srv.chanLock.Unlock()
+	return &TimeoutError{Conns: len(killed), Addrs: killed, Tasks: tasks}
+}
+
+// scaledTimeout returns the timeout for draining n connections with
+// PerConnTimeout.
+func (srv *Server) scaledTimeout(n int) time.Duration {
+	timeout := srv.BaseTimeout + time.Duration(n)*srv.PerConnTimeout
+	if srv.MaxTimeout > 0 && timeout > srv.MaxTimeout {
+		timeout = srv.MaxTimeout
+	}
+	return timeout
+}
+
+// jitter returns a random duration between 0 and TimeoutJitter.
+func (srv *Server) jitter() time.Duration {
+	source := srv.JitterSource
+	if source == nil {
+		source = rand.NewSource(time.Now().UnixNano() ^ int64(os.Getpid()))
+	}
+	return time.Duration(rand.New(source).Int63n(int64(srv.TimeoutJitter) + 1))
+}
+
+// softTimeout returns the SoftTimeout, or zero if it does not apply.
+func (srv *Server) softTimeout() time.Duration {
+	if srv.UseStdlibShutdown {
+		return 0
+	}
+	return srv.SoftTimeout
+}
+
+// keepsConns reports whether connections are left open when draining
+// starts. Keep-alives stay enabled then, since disabling them or calling
+// notifyShutdown closes the idle connections, and the handler installed by
+// Serve closes connections after their response instead.
+func (srv *Server) keepsConns() bool {
+	return srv.NoCloseIdle && !srv.UseStdlibShutdown || srv.drainPipelined()
+}
+
+// askToClose closes the idle connections in tracker, which would otherwise
+// hold the server open until they hit their idle timeout, and those serving
+// PriorityLow requests, and asks the hijacked ones and QUIC sessions to
+// close.
+func (srv *Server) askToClose(tracker ConnTracker) {
+	srv.dropLowPriority()
+	var idle, hijacked []net.Conn
+	var sessions []*quicConn
+	tracker.Range(func(conn net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateIdle:
+			if !srv.NoCloseIdle {
+				idle = append(idle, conn)
+			}
+		case http.StateHijacked:
+			hijacked = append(hijacked, conn)
+		case http.StateActive:
+			if qc, ok := conn.(*quicConn); ok {
+				sessions = append(sessions, qc)
+			}
+		}
+	})
+	for _, conn := range idle {
+		if err := conn.Close(); err != nil {
+			srv.logf("[ERROR] %s", err)
+		}
+	}
+	for _, conn := range hijacked {
+		srv.notifyHijacked(conn)
+	}
+	for _, qc := range sessions {
+		qc.session.Shutdown()
+	}
+}
+
+// killConnections forcefully closes all connections in tracker, and
+// returns their remote addresses.
+func (srv *Server) killConnections(tracker ConnTracker) []net.Addr {
+	atomic.StoreInt32(&srv.killed, 1)
+	srv.stopLock.Lock()
+	defer srv.stopLock.Unlock()
+
+	srv.Server.ConnState = nil
+	var conns []net.Conn
+	tracker.Range(func(conn net.Conn, state http.ConnState) {
+		conns = append(conns, conn)
+	})
+	srv.logf("timeout expired, closing %d connection(s)", len(conns))
+	return srv.forceClose(tracker, conns)
+}
+
+// forceCloseWait bounds how long OnForceClose may hold up the closing of
+// the connections.
+const forceCloseWait = time.Second
+
+// forceClose closes conns and removes them from tracker, after calling
+// OnForceClose for each of them. It returns their remote addresses.
+func (srv *Server) forceClose(tracker ConnTracker, conns []net.Conn) []net.Addr {
+	if srv.OnForceClose != nil && len(conns) > 0 {
+		var wg sync.WaitGroup
+		wg.Add(len(conns))
+		for _, conn := range conns {
+			go func(conn net.Conn) {
+				defer wg.Done()
+				defer func() {
+					if r := recover(); r != nil {
+						srv.logf("[ERROR] OnForceClose panic: %v", r)
+					}
+				}()
+				srv.OnForceClose(conn)
+			}(conn)
+		}
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
 		select {
 		case <-done:
-		case <-time.After(srv.Timeout):
-			close(kill)
+		case <-time.After(forceCloseWait):
+			srv.logf("OnForceClose did not return within %s", forceCloseWait)
 		}
-	} else {
-		<-done
 	}
-	// Close the stopChan to wake up any blocked goroutines.
+
+	addrs := make([]net.Addr, len(conns))
+	for i, conn := range conns {
+		addrs[i] = conn.RemoteAddr()
+		if err := conn.Close(); err != nil {
+			srv.logf("[ERROR] %s", err)
+		}
+		tracker.SetState(conn, http.StateClosed)
+	}
+	return addrs
+}
+
+// drainTimeout returns a channel that is ready when the remaining
+// connections should be forcefully closed, or nil if they never should be.
+func (srv *Server) drainTimeout(timeout time.Duration) <-chan time.Time {
+	if srv.UseStdlibShutdown {
+		if expired := srv.stdlibDrain(timeout); expired != nil {
+			return expired
+		}
+	}
+	if timeout <= 0 {
+		return nil
+	}
+	return srv.clock().After(timeout)
+}
+
+// closeStopChan records the shutdown result and closes the stopChan to
+// wake up any blocked goroutines.
+func (srv *Server) closeStopChan(err error) {
+	srv.logf("shutdown complete")
+	atomic.StoreInt32(&srv.state, stateStopped)
 	srv.chanLock.Lock()
+	srv.stopErr = err
 	if srv.stopChan != nil {
 		close(srv.stopChan)
 	}
+	if srv.doneChan == nil {
+		srv.doneChan = make(chan error, 1)
+	}
+	select {
+	case srv.doneChan <- err:
+	default:
+	}
 	srv.chanLock.Unlock()
 }
@@ -0,0 +1,77 @@
+// +build go1.13
+
+package graceful
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTimeoutErrorIs(t *testing.T) {
+	err := fmt.Errorf("stopping: %w", &TimeoutError{Conns: 2})
+	if !errors.Is(err, ErrTimedOut) {
+		t.Fatal("expected a TimeoutError to be ErrTimedOut")
+	}
+	var terr *TimeoutError
+	if !errors.As(err, &terr) || terr.Conns != 2 {
+		t.Fatalf("expected to retrieve the TimeoutError, got %v", terr)
+	}
+}
+
+func TestExtendDeadlineUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graceful")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sock")
+
+	// Both connections have the same empty remote address, so only the
+	// request context tells them apart.
+	type userKey struct{}
+	found := make(chan bool, 2)
+	release := make(chan struct{})
+	srv := &Server{Timeout: killTime, NoSignalHandling: true}
+	srv.Server = &http.Server{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			found <- srv.ExtendDeadline(r) && r.Context().Value(userKey{}) != nil
+			<-release
+		}),
+		// The http.Server's own ConnContext is still called.
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, userKey{}, true)
+		},
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer srv.StopWithResult(killTime)
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		},
+	}}
+	defer close(release)
+	for i := 0; i < 2; i++ {
+		go func() {
+			if r, err := client.Get("http://unix/"); err == nil {
+				r.Body.Close()
+			}
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if !<-found {
+			t.Fatal("expected the connection to be found")
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// +build go1.8
+
+package graceful
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"time"
+)
+
+// ErrServerClosed is returned by Serve and its variants after the server
+// has been shut down cleanly. It is http.ErrServerClosed.
+var ErrServerClosed = http.ErrServerClosed
+
+// notifyShutdown tells the underlying http.Server that it is shutting down.
+// This sends a GOAWAY frame to HTTP/2 clients so that in-flight streams can
+// finish before their connection is closed. It does not wait for anything.
+func (srv *Server) notifyShutdown() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	srv.Server.Shutdown(ctx)
+}
+
+// enableHTTP2 advertises HTTP/2 in config the same way http.Server.ServeTLS
+// does, unless it has been disabled by setting TLSNextProto. Since Go 1.9,
+// http.Server.Serve only enables HTTP/2 if the listener already offers it.
+func (srv *Server) enableHTTP2(config *tls.Config) {
+	if srv.TLSNextProto != nil {
+		return
+	}
+	hasH2, hasHTTP1 := false, false
+	for _, p := range config.NextProtos {
+		switch p {
+		case "h2":
+			hasH2 = true
+		case "http/1.1":
+			hasHTTP1 = true
+		}
+	}
+	if !hasH2 {
+		config.NextProtos = append([]string{"h2"}, config.NextProtos...)
+	}
+	if !hasHTTP1 {
+		config.NextProtos = append(config.NextProtos, "http/1.1")
+	}
+}
+
+// applyTimeouts sets the default timeouts for ApplyTimeouts.
+func (srv *Server) applyTimeouts() {
+	if srv.ReadHeaderTimeout == 0 {
+		srv.ReadHeaderTimeout = DefaultReadHeaderTimeout
+	}
+	if srv.IdleTimeout == 0 {
+		srv.IdleTimeout = DefaultIdleTimeout
+	}
+}
+
+// hasCertificate reports whether config can provide a certificate without
+// one being loaded from files.
+func hasCertificate(config *tls.Config) bool {
+	return len(config.Certificates) > 0 || config.GetCertificate != nil || config.GetConfigForClient != nil
+}
+
+// cloneTLSConfig returns a shallow copy of config.
+func cloneTLSConfig(config *tls.Config) *tls.Config {
+	return config.Clone()
+}
+
+// stdlibDrain drains connections with http.Server.Shutdown, bounded by
+// timeout. The returned channel is closed if the timeout expires first.
+func (srv *Server) stdlibDrain(timeout time.Duration) <-chan time.Time {
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+
+	expired := make(chan time.Time)
+	go func() {
+		defer cancel()
+		if srv.Server.Shutdown(ctx) == context.DeadlineExceeded {
+			close(expired)
+		}
+	}()
+	return expired
+}
@@ -0,0 +1,175 @@
+// +build go1.8
+
+package graceful
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUseStdlibShutdown(t *testing.T) {
+	server, l, err := createListener(killTime / 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Timeout: killTime, Server: server, NoSignalHandling: true, UseStdlibShutdown: true}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	for i := 0; i < concurrentRequestN; i++ {
+		wg.Add(1)
+		go runQuery(t, http.StatusOK, false, &wg, &once)
+	}
+	time.Sleep(waitTime)
+
+	if err := srv.StopWithResult(killTime); err != nil {
+		t.Fatalf("expected a clean shutdown, got %s", err)
+	}
+	wg.Wait()
+}
+
+func TestUseStdlibShutdownTimesOut(t *testing.T) {
+	server, l, err := createListener(killTime * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: server, NoSignalHandling: true, UseStdlibShutdown: true}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	for i := 0; i < concurrentRequestN; i++ {
+		wg.Add(1)
+		go runQuery(t, 0, true, &wg, &once)
+	}
+	time.Sleep(waitTime)
+
+	err = srv.StopWithResult(killTime)
+	wg.Wait()
+
+	terr, ok := err.(*TimeoutError)
+	if !ok {
+		t.Fatalf("expected a *TimeoutError, got %#v", err)
+	}
+	if terr.Conns != concurrentRequestN {
+		t.Fatalf("expected %d killed connections, got %d", concurrentRequestN, terr.Conns)
+	}
+}
+
+func TestApplyTimeouts(t *testing.T) {
+	srv := &Server{Server: &http.Server{IdleTimeout: time.Second}}
+	srv.ApplyTimeouts()
+
+	if srv.ReadHeaderTimeout != DefaultReadHeaderTimeout {
+		t.Errorf("expected ReadHeaderTimeout %s, got %s", DefaultReadHeaderTimeout, srv.ReadHeaderTimeout)
+	}
+	if srv.IdleTimeout != time.Second {
+		t.Errorf("expected IdleTimeout to be left at 1s, got %s", srv.IdleTimeout)
+	}
+	if srv.ReadTimeout != 0 || srv.WriteTimeout != 0 {
+		t.Error("ReadTimeout and WriteTimeout should be left alone")
+	}
+}
+
+func TestNoDefaultTimeouts(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: server, NoSignalHandling: true, NoDefaultTimeouts: true}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+	srv.StopWithResult(killTime)
+
+	if srv.ReadHeaderTimeout != 0 || srv.IdleTimeout != 0 {
+		t.Error("timeouts should not be set when NoDefaultTimeouts is set")
+	}
+}
+
+func TestServeTLSGetConfigForClient(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("test-fixtures/cert.crt", "test-fixtures/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := make(chan string, 1)
+	server, l, err := createListener(killTime / 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.TLSConfig = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			names <- hello.ServerName
+			return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+		},
+	}
+	srv := &Server{Timeout: killTime, Server: server, NoSignalHandling: true}
+	go srv.ServeTLS(l, "", "")
+	time.Sleep(waitTime)
+
+	client := http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true, ServerName: "tenant.example.com"},
+	}}
+	errc := make(chan error, 1)
+	go func() {
+		r, err := client.Get(fmt.Sprintf("https://localhost:%d", port))
+		if err == nil && r.StatusCode != http.StatusOK {
+			err = fmt.Errorf("unexpected status code %d", r.StatusCode)
+		}
+		errc <- err
+	}()
+	time.Sleep(waitTime)
+
+	if err := srv.StopWithResult(killTime); err != nil {
+		t.Fatalf("expected a clean shutdown, got %s", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if name := <-names; name != "tenant.example.com" {
+		t.Fatalf("expected GetConfigForClient to see the SNI name, got %q", name)
+	}
+}
+
+func TestServeTLSMidHandshake(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("test-fixtures/cert.crt", "test-fixtures/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	srv := &Server{Server: server, NoSignalHandling: true}
+	go srv.ServeTLS(l, "", "")
+	time.Sleep(waitTime)
+
+	// a client that connects but never starts its handshake
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(waitTime)
+
+	if srv.ActiveConnections() != 1 {
+		t.Fatalf("expected the connection to be tracked during its handshake, got %d", srv.ActiveConnections())
+	}
+	terr, ok := srv.StopWithResult(killTime).(*TimeoutError)
+	if !ok || terr.Conns != 1 {
+		t.Fatalf("expected the connection to be closed when the timeout expires, got %#v", terr)
+	}
+}
@@ -0,0 +1,40 @@
+// +build !go1.8
+
+package graceful
+
+import (
+	"crypto/tls"
+	"errors"
+	"time"
+)
+
+// ErrServerClosed is returned by Serve and its variants after the server
+// has been shut down cleanly. It matches http.ErrServerClosed, which was
+// added in Go 1.8.
+var ErrServerClosed = errors.New("http: Server closed")
+
+// notifyShutdown is a no-op before Go 1.8, which lacks http.Server.Shutdown.
+func (srv *Server) notifyShutdown() {}
+
+// enableHTTP2 is a no-op before Go 1.8, where http.Server.Serve configures
+// HTTP/2 on its own.
+func (srv *Server) enableHTTP2(config *tls.Config) {}
+
+// applyTimeouts is a no-op before Go 1.8, which lacks ReadHeaderTimeout and
+// IdleTimeout.
+func (srv *Server) applyTimeouts() {}
+
+// hasCertificate reports whether config can provide a certificate without
+// one being loaded from files.
+func hasCertificate(config *tls.Config) bool {
+	return len(config.Certificates) > 0 || config.GetCertificate != nil
+}
+
+// cloneTLSConfig returns a shallow copy of config.
+func cloneTLSConfig(config *tls.Config) *tls.Config {
+	c := *config
+	return &c
+}
+
+// stdlibDrain returns nil before Go 1.8, so that the usual drain is used.
+func (srv *Server) stdlibDrain(timeout time.Duration) <-chan time.Time { return nil }
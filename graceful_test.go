@@ -1,17 +1,26 @@
 package graceful
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -134,6 +143,214 @@ func TestGracefulRun(t *testing.T) {
 	go launchTestQueries(t, &wg, c)
 }
 
+func TestRunWithErrListenError(t *testing.T) {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// the port is already in use, so RunWithErr must return instead of blocking
+	errc := make(chan error, 1)
+	go func() { errc <- RunWithErr(fmt.Sprintf(":%d", port), killTime, http.NewServeMux()) }()
+
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Fatal("expected a listen error")
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("RunWithErr should return when it cannot listen")
+	}
+}
+
+func TestListenAndServeTLSConfigCert(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("test-fixtures/cert.crt", "test-fixtures/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(killTime / 2)
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	c := make(chan os.Signal, 1)
+	srv := &Server{Timeout: killTime, interrupt: c, Server: &http.Server{
+		Addr:      fmt.Sprintf(":%d", port),
+		Handler:   mux,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	}}
+	go srv.ListenAndServeTLS("", "")
+	time.Sleep(waitTime)
+
+	client := http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	errc := make(chan error, 1)
+	go func() {
+		r, err := client.Get(fmt.Sprintf("https://localhost:%d", port))
+		if err == nil && r.StatusCode != http.StatusOK {
+			err = fmt.Errorf("unexpected status code %d", r.StatusCode)
+		}
+		errc <- err
+	}()
+
+	// interrupt while the request is in flight
+	time.Sleep(waitTime)
+	c <- os.Interrupt
+
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for server to stop")
+	}
+}
+
+func TestActiveConnections(t *testing.T) {
+	srv := &Server{NoSignalHandling: true}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(rw, srv.ActiveConnections())
+	})
+	srv.Server = &http.Server{Handler: mux}
+
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	r, err := http.Get(fmt.Sprintf("http://localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "1" {
+		t.Fatalf("expected 1 active connection, got %s", body)
+	}
+
+	srv.Stop(0)
+	<-srv.StopChan()
+
+	if n := srv.ActiveConnections(); n != 0 {
+		t.Fatalf("expected no active connections after stop, got %d", n)
+	}
+}
+
+func TestServeMulti(t *testing.T) {
+	server, l1, err := createListener(killTime / 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Timeout: killTime, Server: server, NoSignalHandling: true}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ServeMulti(l1, l2) }()
+	time.Sleep(waitTime)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	for _, addr := range []string{l1.Addr().String(), l2.Addr().String()} {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			r, err := http.Get("http://" + addr)
+			if err != nil || r.StatusCode != http.StatusOK {
+				once.Do(func() { t.Errorf("request to %s failed: %v", addr, err) })
+			}
+		}(addr)
+	}
+	time.Sleep(waitTime)
+
+	if err := srv.StopWithResult(killTime); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	if err := <-errc; err != ErrServerClosed {
+		t.Fatalf("expected %v, got %v", ErrServerClosed, err)
+	}
+	for _, l := range []net.Listener{l1, l2} {
+		if c, err := net.Dial("tcp", l.Addr().String()); err == nil {
+			c.Close()
+			t.Fatalf("listener on %s should be closed", l.Addr())
+		}
+	}
+}
+
+func TestServerState(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: server, NoSignalHandling: true}
+	if srv.IsRunning() || srv.Stopped() {
+		t.Fatal("server should be neither running nor stopped before Serve")
+	}
+
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+	if !srv.IsRunning() {
+		t.Fatal("server should be running")
+	}
+
+	l2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Serve(l2); err != ErrAlreadyRunning {
+		t.Fatalf("expected ErrAlreadyRunning, got %v", err)
+	}
+
+	srv.Stop(0)
+	<-srv.StopChan()
+	if srv.IsRunning() || !srv.Stopped() {
+		t.Fatal("server should be stopped")
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	server, l, err := createListener(killTime * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Timeout: killTime, RequestTimeout: waitTime, Server: server, NoSignalHandling: true}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	wg.Add(1)
+	start := time.Now()
+	runQuery(t, http.StatusServiceUnavailable, false, &wg, &once)
+	if d := time.Since(start); d > killTime {
+		t.Fatalf("request should have been cut off after %s, took %s", waitTime, d)
+	}
+
+	if err := srv.StopWithResult(killTime); err != nil {
+		t.Fatalf("expected a clean shutdown, got %s", err)
+	}
+}
+
 func TestGracefulRunLimitKeepAliveListener(t *testing.T) {
 	var wg sync.WaitGroup
 	defer wg.Wait()
@@ -263,6 +480,35 @@ func TestGracefulRunDoesntTimeOutAfterConnectionCreated(t *testing.T) {
 	wg.Wait()
 }
 
+func TestNoCloseIdle(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: server, NoSignalHandling: true, NoCloseIdle: true}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	transport := &http.Transport{}
+	defer transport.CloseIdleConnections()
+	resp, err := (&http.Client{Transport: transport}).Get(fmt.Sprintf("http://localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// The idle connection lingers until the timeout closes it.
+	err = srv.StopWithResult(killTime)
+	terr, ok := err.(*TimeoutError)
+	if !ok {
+		t.Fatalf("expected a *TimeoutError, got %#v", err)
+	}
+	if terr.Conns != 1 {
+		t.Fatalf("expected 1 killed connection, got %d", terr.Conns)
+	}
+}
+
 func TestGracefulRunNoRequests(t *testing.T) {
 	var wg sync.WaitGroup
 	defer wg.Wait()
@@ -352,228 +598,284 @@ func TestGracefulExplicitStop(t *testing.T) {
 	}
 }
 
-func TestGracefulExplicitStopOverride(t *testing.T) {
+func TestStopWithResult(t *testing.T) {
 	server, l, err := createListener(1 * time.Millisecond)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	srv := &Server{Timeout: killTime, Server: server}
+	srv := &Server{Server: server, NoSignalHandling: true}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
 
-	go func() {
-		go srv.Serve(l)
-		time.Sleep(waitTime)
-		srv.Stop(killTime / 2)
-	}()
+	if err := srv.StopWithResult(killTime); err != nil {
+		t.Fatalf("expected a clean shutdown, got %s", err)
+	}
 
-	// block on the stopChan until the server has shut down
 	select {
-	case <-srv.StopChan():
-	case <-time.After(killTime):
-		t.Fatal("Timed out while waiting for explicit stop to complete")
+	case <-srv.TimedOut():
+		t.Fatal("TimedOut channel should not be closed after a clean shutdown")
+	default:
 	}
 }
 
-func TestBeforeShutdownAndShutdownInitiatedCallbacks(t *testing.T) {
-	var wg sync.WaitGroup
-	defer wg.Wait()
-
-	server, l, err := createListener(1 * time.Millisecond)
+func TestStopWithResultTimesOut(t *testing.T) {
+	server, l, err := createListener(killTime * 10)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	beforeShutdownCalled := make(chan struct{})
-	cb1 := func() bool { close(beforeShutdownCalled); return true }
-	shutdownInitiatedCalled := make(chan struct{})
-	cb2 := func() { close(shutdownInitiatedCalled) }
+	srv := &Server{Server: server, NoSignalHandling: true}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
 
-	wg.Add(2)
-	srv := &Server{Server: server, BeforeShutdown: cb1, ShutdownInitiated: cb2}
-	go func() {
-		defer wg.Done()
-		srv.Serve(l)
-	}()
-	go func() {
-		defer wg.Done()
-		time.Sleep(waitTime)
-		srv.Stop(killTime)
-	}()
+	var wg sync.WaitGroup
+	var once sync.Once
+	for i := 0; i < concurrentRequestN; i++ {
+		wg.Add(1)
+		go runQuery(t, 0, true, &wg, &once)
+	}
+	time.Sleep(waitTime)
 
-	beforeShutdown := false
-	shutdownInitiated := false
-	for i := 0; i < 2; i++ {
-		select {
-		case <-beforeShutdownCalled:
-			beforeShutdownCalled = nil
-			beforeShutdown = true
-		case <-shutdownInitiatedCalled:
-			shutdownInitiatedCalled = nil
-			shutdownInitiated = true
-		case <-time.After(killTime):
-			t.Fatal("Timed out while waiting for ShutdownInitiated callback to be called")
-		}
+	err = srv.StopWithResult(killTime)
+	wg.Wait()
+
+	select {
+	case <-srv.TimedOut():
+	default:
+		t.Fatal("TimedOut channel should be closed")
 	}
 
-	if !beforeShutdown {
-		t.Fatal("beforeShutdown should be true")
+	terr, ok := err.(*TimeoutError)
+	if !ok {
+		t.Fatalf("expected a *TimeoutError, got %#v", err)
 	}
-	if !shutdownInitiated {
-		t.Fatal("shutdownInitiated should be true")
+	if terr.Conns != concurrentRequestN {
+		t.Fatalf("expected %d killed connections, got %d", concurrentRequestN, terr.Conns)
 	}
 }
 
-func TestBeforeShutdownCanceled(t *testing.T) {
+func TestProfileOnTimeout(t *testing.T) {
+	server, l, err := createListener(killTime * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var profile bytes.Buffer
+	srv := &Server{Server: server, NoSignalHandling: true, ProfileOnTimeout: &profile}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
 	var wg sync.WaitGroup
+	var once sync.Once
 	wg.Add(1)
+	go runQuery(t, 0, true, &wg, &once)
+	time.Sleep(waitTime)
 
-	server, l, err := createListener(1 * time.Millisecond)
+	if _, ok := srv.StopWithResult(killTime).(*TimeoutError); !ok {
+		t.Fatal("expected the shutdown to time out")
+	}
+	wg.Wait()
+
+	// The stuck handler shows up in the stacks.
+	if !strings.Contains(profile.String(), "createListener") {
+		t.Fatalf("expected the goroutine profile to show the stuck handler, got %q", profile.String())
+	}
+}
+
+func TestStreamedBodyDrains(t *testing.T) {
+	const chunks, chunkSize = 32, 256 << 10
+	started := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		close(started)
+		chunk := bytes.Repeat([]byte("x"), chunkSize)
+		for i := 0; i < chunks; i++ {
+			rw.Write(chunk)
+			rw.(http.Flusher).Flush()
+			time.Sleep(waitTime / 10)
+		}
+	})
+	server := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux}
+	l, err := net.Listen("tcp", server.Addr)
 	if err != nil {
 		t.Fatal(err)
 	}
+	srv := &Server{Server: server, NoSignalHandling: true}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
 
-	beforeShutdownCalled := make(chan struct{})
-	cb1 := func() bool { close(beforeShutdownCalled); return false }
-	shutdownInitiatedCalled := make(chan struct{})
-	cb2 := func() { close(shutdownInitiatedCalled) }
-
-	srv := &Server{Server: server, BeforeShutdown: cb1, ShutdownInitiated: cb2}
-	go func() {
-		srv.Serve(l)
-		wg.Done()
-	}()
+	received := make(chan int64, 1)
 	go func() {
-		time.Sleep(waitTime)
-		srv.Stop(killTime)
+		resp, err := http.Get(fmt.Sprintf("http://localhost:%d", port))
+		if err != nil {
+			received <- -1
+			return
+		}
+		defer resp.Body.Close()
+		n, _ := io.Copy(ioutil.Discard, resp.Body)
+		received <- n
 	}()
+	<-started
 
-	beforeShutdown := false
-	shutdownInitiated := false
-	timeouted := false
+	// The connection only counts as finished once the whole body has been
+	// written, so the drain ends cleanly within the Timeout.
+	if err := srv.StopWithResult(5 * timeoutTime); err != nil {
+		t.Fatalf("expected a clean shutdown, got %s", err)
+	}
+	if n := <-received; n != chunks*chunkSize {
+		t.Fatalf("expected the whole body of %d bytes, got %d", chunks*chunkSize, n)
+	}
+}
 
-	for i := 0; i < 2; i++ {
-		select {
-		case <-beforeShutdownCalled:
-			beforeShutdownCalled = nil
-			beforeShutdown = true
-		case <-shutdownInitiatedCalled:
-			shutdownInitiatedCalled = nil
-			shutdownInitiated = true
-		case <-time.After(killTime):
-			timeouted = true
-		}
+func TestStopChanPrompt(t *testing.T) {
+	finished := make(chan time.Time, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(killTime)
+		rw.WriteHeader(http.StatusOK)
+		finished <- time.Now()
+	})
+	server := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux}
+	l, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	if !beforeShutdown {
-		t.Fatal("beforeShutdown should be true")
-	}
-	if !timeouted {
-		t.Fatal("timeouted should be true")
-	}
-	if shutdownInitiated {
-		t.Fatal("shutdownInitiated shouldn't be true")
-	}
+	srv := &Server{Server: server, NoSignalHandling: true}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
 
-	srv.BeforeShutdown = func() bool { return true }
-	srv.Stop(killTime)
+	var wg sync.WaitGroup
+	var once sync.Once
+	wg.Add(1)
+	go runQuery(t, http.StatusOK, false, &wg, &once)
+	time.Sleep(waitTime)
 
+	srv.Stop(timeoutTime * 10)
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime * 5):
+		t.Fatal("timed out waiting for StopChan")
+	}
+	stopped := time.Now()
 	wg.Wait()
+
+	// The drain is woken as connections close rather than polling, so
+	// StopChan fires right after the last one goes away.
+	if d := stopped.Sub(<-finished); d > waitTime {
+		t.Fatalf("expected StopChan to fire promptly after the last connection closed, took %s", d)
+	}
 }
 
-func hijackingListener(srv *Server) (*http.Server, net.Listener, error) {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
-		conn, bufrw, err := rw.(http.Hijacker).Hijack()
-		if err != nil {
-			http.Error(rw, "webserver doesn't support hijacking", http.StatusInternalServerError)
-			return
-		}
+func TestDone(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-		defer conn.Close()
+	srv := &Server{Server: server, NoSignalHandling: true}
+	done := srv.Done()
+	go srv.Serve(l)
+	time.Sleep(waitTime)
 
-		bufrw.WriteString("HTTP/1.1 200 OK\r\n\r\n")
-		bufrw.Flush()
-	})
+	srv.Stop(killTime)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected a clean shutdown, got %s", err)
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the shutdown result")
+	}
 
-	server := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux}
-	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
-	return server, l, err
+	select {
+	case err := <-srv.Done():
+		t.Fatalf("expected the result to be delivered once, got %v", err)
+	default:
+	}
 }
 
-func TestNotifyClosed(t *testing.T) {
-	var wg sync.WaitGroup
-	defer wg.Wait()
-
-	c := make(chan os.Signal, 1)
-	srv := &Server{Timeout: killTime, interrupt: c}
-	server, l, err := hijackingListener(srv)
+func TestDoneTimesOut(t *testing.T) {
+	server, l, err := createListener(killTime * 10)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	srv.Server = server
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		srv.Serve(l)
-	}()
+	srv := &Server{Server: server, NoSignalHandling: true}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
 
+	var wg sync.WaitGroup
 	var once sync.Once
 	for i := 0; i < concurrentRequestN; i++ {
 		wg.Add(1)
-		runQuery(t, http.StatusOK, false, &wg, &once)
+		go runQuery(t, 0, true, &wg, &once)
 	}
+	time.Sleep(waitTime)
 
-	srv.Stop(0)
+	srv.Stop(killTime)
+	wg.Wait()
+	<-srv.StopChan()
 
-	// block on the stopChan until the server has shut down
+	// Asking for the channel after the server stopped still delivers the
+	// result.
 	select {
-	case <-srv.StopChan():
-	case <-time.After(timeoutTime):
-		t.Fatal("Timed out while waiting for explicit stop to complete")
-	}
-
-	if len(srv.connections) > 0 {
-		t.Fatal("hijacked connections should not be managed")
+	case err := <-srv.Done():
+		if _, ok := err.(*TimeoutError); !ok {
+			t.Fatalf("expected a *TimeoutError, got %#v", err)
+		}
+	default:
+		t.Fatal("expected the shutdown result to be ready")
 	}
-
 }
 
-func TestStopDeadlock(t *testing.T) {
-	var wg sync.WaitGroup
-	defer wg.Wait()
+func TestOnShutdownComplete(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(killTime * 10)
+		}
+		rw.WriteHeader(http.StatusOK)
+	})
 
-	c := make(chan struct{})
-	server, l, err := createListener(1 * time.Millisecond)
+	statsc := make(chan ShutdownStats, 1)
+	srv := &Server{Server: &http.Server{Handler: mux}, NoSignalHandling: true,
+		OnShutdownComplete: func(stats ShutdownStats) { statsc <- stats }}
+
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		t.Fatal(err)
 	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
 
-	srv := &Server{Server: server, NoSignalHandling: true}
+	// one connection finishes during the drain and one is killed
+	go http.Get(fmt.Sprintf("http://localhost:%d/slow", port))
+	idle := &http.Client{Transport: &http.Transport{}}
+	r, err := idle.Get(fmt.Sprintf("http://localhost:%d/", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	time.Sleep(waitTime)
 
-	wg.Add(2)
-	go func() {
-		defer wg.Done()
-		time.Sleep(waitTime)
-		srv.Serve(l)
-	}()
-	go func() {
-		defer wg.Done()
-		srv.Stop(0)
-		close(c)
-	}()
+	srv.StopWithResult(killTime)
 
 	select {
-	case <-c:
-		l.Close()
-	case <-time.After(timeoutTime):
-		t.Fatal("Timed out while waiting for explicit stop to complete")
+	case stats := <-statsc:
+		if stats.ForcedConnections != 1 || stats.CleanConnections != 1 {
+			t.Fatalf("unexpected stats %+v", stats)
+		}
+		if stats.Duration < killTime {
+			t.Fatalf("expected the drain to take at least %s, took %s", killTime, stats.Duration)
+		}
+	default:
+		t.Fatal("OnShutdownComplete should be called before the stop channel is closed")
 	}
 }
 
-// Run with --race
-func TestStopRace(t *testing.T) {
+func TestGracefulExplicitStopOverride(t *testing.T) {
 	server, l, err := createListener(1 * time.Millisecond)
 	if err != nil {
 		t.Fatal(err)
@@ -583,91 +885,930 @@ func TestStopRace(t *testing.T) {
 
 	go func() {
 		go srv.Serve(l)
-		srv.Stop(killTime)
+		time.Sleep(waitTime)
+		srv.Stop(killTime / 2)
 	}()
-	srv.Stop(0)
+
+	// block on the stopChan until the server has shut down
 	select {
 	case <-srv.StopChan():
-	case <-time.After(timeoutTime):
+	case <-time.After(killTime):
 		t.Fatal("Timed out while waiting for explicit stop to complete")
 	}
 }
 
-func TestInterruptLog(t *testing.T) {
-	c := make(chan os.Signal, 1)
+func TestBeforeShutdownAndShutdownInitiatedCallbacks(t *testing.T) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
 
-	server, l, err := createListener(killTime * 10)
+	server, l, err := createListener(1 * time.Millisecond)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	var buf bytes.Buffer
-	var tbuf bytes.Buffer
-	logger := log.New(&buf, "", 0)
-	expected := log.New(&tbuf, "", 0)
-
-	srv := &Server{Timeout: killTime, Server: server, Logger: logger, interrupt: c}
-	go func() { srv.Serve(l) }()
+	beforeShutdownCalled := make(chan struct{})
+	cb1 := func() bool { close(beforeShutdownCalled); return true }
+	shutdownInitiatedCalled := make(chan struct{})
+	cb2 := func() { close(shutdownInitiatedCalled) }
 
-	stop := srv.StopChan()
-	c <- os.Interrupt
-	expected.Print("shutdown initiated")
+	wg.Add(2)
+	srv := &Server{Server: server, BeforeShutdown: cb1, ShutdownInitiated: cb2}
+	go func() {
+		defer wg.Done()
+		srv.Serve(l)
+	}()
+	go func() {
+		defer wg.Done()
+		time.Sleep(waitTime)
+		srv.Stop(killTime)
+	}()
 
-	<-stop
+	beforeShutdown := false
+	shutdownInitiated := false
+	for i := 0; i < 2; i++ {
+		select {
+		case <-beforeShutdownCalled:
+			beforeShutdownCalled = nil
+			beforeShutdown = true
+		case <-shutdownInitiatedCalled:
+			shutdownInitiatedCalled = nil
+			shutdownInitiated = true
+		case <-time.After(killTime):
+			t.Fatal("Timed out while waiting for ShutdownInitiated callback to be called")
+		}
+	}
 
-	if buf.String() != tbuf.String() {
-		t.Fatal("shutdown log incorrect - got '" + buf.String() + "'")
+	if !beforeShutdown {
+		t.Fatal("beforeShutdown should be true")
+	}
+	if !shutdownInitiated {
+		t.Fatal("shutdownInitiated should be true")
 	}
 }
 
-func TestMultiInterrupts(t *testing.T) {
-	c := make(chan os.Signal, 1)
-
-	server, l, err := createListener(killTime * 10)
+func TestOnListen(t *testing.T) {
+	var registered int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&registered) == 0 {
+			t.Error("expected OnListen to return before the request was served")
+		}
+	})
+	server := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux}
+	l, err := net.Listen("tcp", server.Addr)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	var wg sync.WaitGroup
-	var bu bytes.Buffer
-	buf := SyncBuffer{&wg, &bu}
-	var tbuf bytes.Buffer
-	logger := log.New(&buf, "", 0)
-	expected := log.New(&tbuf, "", 0)
+	addrs := make(chan net.Addr, 1)
+	srv := &Server{Server: server, NoSignalHandling: true, OnListen: func(addr net.Addr) {
+		addrs <- addr
+		time.Sleep(waitTime)
+		atomic.StoreInt32(&registered, 1)
+	}}
+	go srv.Serve(l)
 
-	srv := &Server{Timeout: killTime, Server: server, Logger: logger, interrupt: c}
-	go func() { srv.Serve(l) }()
+	// The connection is queued until OnListen has returned.
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if addr := <-addrs; addr.String() != l.Addr().String() {
+		t.Fatalf("expected OnListen to be called with %s, got %s", l.Addr(), addr)
+	}
+	srv.StopWithResult(killTime)
+}
 
-	stop := srv.StopChan()
-	buf.Add(1 + 10) // Expecting 11 log calls
-	c <- os.Interrupt
-	expected.Printf("shutdown initiated")
-	for i := 0; i < 10; i++ {
-		c <- os.Interrupt
-		expected.Printf("already shutting down")
+func TestOnListenerClosed(t *testing.T) {
+	server, l, err := createListener(killTime / 2)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	<-stop
+	var mu sync.Mutex
+	var events []string
+	record := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+	srv := &Server{Server: server, NoSignalHandling: true}
+	srv.ShutdownInitiated = func() { record("initiated") }
+	srv.OnShutdownComplete = func(ShutdownStats) { record("complete") }
+	srv.OnListenerClosed = func() {
+		if !srv.Draining() || srv.ActiveConnections() != 1 {
+			t.Errorf("expected the request to be draining, got %d connection(s)", srv.ActiveConnections())
+		}
+		record("closed")
+	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	wg.Add(1)
+	go runQuery(t, http.StatusOK, false, &wg, &once)
+	time.Sleep(waitTime)
 
+	srv.Stop(killTime)
 	wg.Wait()
-	bb, bt := buf.Bytes(), tbuf.Bytes()
-	for i, b := range bb {
-		if b != bt[i] {
-			t.Fatal(fmt.Sprintf("shutdown log incorrect - got '%s', expected '%s'", buf.String(), tbuf.String()))
-		}
+	<-srv.StopChan()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(events, []string{"initiated", "closed", "complete"}) {
+		t.Fatalf("callbacks called in the wrong order: %v", events)
 	}
 }
 
-func TestLogFunc(t *testing.T) {
-	c := make(chan os.Signal, 1)
+func TestBeforeShutdownCanceled(t *testing.T) {
+	var wg sync.WaitGroup
+	wg.Add(1)
 
-	server, l, err := createListener(killTime * 10)
+	server, l, err := createListener(1 * time.Millisecond)
 	if err != nil {
 		t.Fatal(err)
 	}
-	var called bool
-	srv := &Server{Timeout: killTime, Server: server,
-		LogFunc: func(format string, args ...interface{}) {
+
+	beforeShutdownCalled := make(chan struct{})
+	cb1 := func() bool { close(beforeShutdownCalled); return false }
+	shutdownInitiatedCalled := make(chan struct{})
+	cb2 := func() { close(shutdownInitiatedCalled) }
+
+	srv := &Server{Server: server, BeforeShutdown: cb1, ShutdownInitiated: cb2}
+	go func() {
+		srv.Serve(l)
+		wg.Done()
+	}()
+	go func() {
+		time.Sleep(waitTime)
+		srv.Stop(killTime)
+	}()
+
+	beforeShutdown := false
+	shutdownInitiated := false
+	timeouted := false
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-beforeShutdownCalled:
+			beforeShutdownCalled = nil
+			beforeShutdown = true
+		case <-shutdownInitiatedCalled:
+			shutdownInitiatedCalled = nil
+			shutdownInitiated = true
+		case <-time.After(killTime):
+			timeouted = true
+		}
+	}
+
+	if !beforeShutdown {
+		t.Fatal("beforeShutdown should be true")
+	}
+	if !timeouted {
+		t.Fatal("timeouted should be true")
+	}
+	if shutdownInitiated {
+		t.Fatal("shutdownInitiated shouldn't be true")
+	}
+
+	srv.BeforeShutdown = func() bool { return true }
+	srv.Stop(killTime)
+
+	wg.Wait()
+}
+
+func TestStopVetoedKeepsTimeout(t *testing.T) {
+	server, l, err := createListener(killTime / 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first shutdown is vetoed, and the next one goes ahead.
+	asked, vetoed := make(chan struct{}, 2), false
+	srv := &Server{Timeout: killTime, Server: server, NoSignalHandling: true}
+	srv.BeforeShutdown = func() bool {
+		allow := vetoed
+		vetoed = true
+		asked <- struct{}{}
+		return allow
+	}
+	go srv.Serve(l)
+	<-srv.Ready()
+
+	// The vetoed Stop must not leave its timeout in place of the Timeout.
+	srv.Stop(time.Millisecond)
+	<-asked
+
+	result := make(chan error, 1)
+	go func() {
+		r, err := http.Get(fmt.Sprintf("http://localhost:%d", port))
+		if err == nil {
+			r.Body.Close()
+		}
+		result <- err
+	}()
+	time.Sleep(waitTime)
+	stop := srv.TriggerShutdown()
+	if err := <-result; err != nil {
+		t.Fatalf("expected the request to finish, got %v", err)
+	}
+	<-stop
+}
+
+func TestGraceWindow(t *testing.T) {
+	c := make(chan os.Signal, 1)
+
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Timeout: killTime, GraceWindow: killTime, Server: server, interrupt: c}
+	go srv.Serve(l)
+
+	stop := srv.StopChan()
+	time.Sleep(waitTime)
+	c <- os.Interrupt
+	time.Sleep(waitTime)
+
+	if srv.Draining() {
+		t.Fatal("server should not be draining during the grace window")
+	}
+
+	// new requests are still served during the grace window
+	var wg sync.WaitGroup
+	var once sync.Once
+	wg.Add(1)
+	runQuery(t, http.StatusOK, false, &wg, &once)
+
+	select {
+	case <-stop:
+		t.Fatal("server stopped before the grace window passed")
+	default:
+	}
+
+	select {
+	case <-stop:
+	case <-time.After(killTime + timeoutTime):
+		t.Fatal("Timed out while waiting for server to stop after the grace window")
+	}
+
+	if !srv.Stopped() {
+		t.Fatal("server should be stopped once the grace window has passed")
+	}
+}
+
+func TestOnDrainTick(t *testing.T) {
+	c := make(chan os.Signal, 1)
+
+	server, l, err := createListener(killTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ticks := make(chan int, 100)
+	srv := &Server{Timeout: timeoutTime, Server: server, interrupt: c,
+		DrainTickInterval: waitTime,
+		OnDrainTick:       func(remaining int) { ticks <- remaining }}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	wg.Add(1)
+	go runQuery(t, http.StatusOK, false, &wg, &once)
+	time.Sleep(waitTime)
+
+	c <- os.Interrupt
+	wg.Wait()
+	<-srv.StopChan()
+	close(ticks)
+
+	n := 0
+	for remaining := range ticks {
+		if remaining != 1 {
+			t.Fatalf("expected 1 remaining connection, got %d", remaining)
+		}
+		n++
+	}
+	if n == 0 {
+		t.Fatal("OnDrainTick should be called while draining")
+	}
+}
+
+func TestShutdownInitiatedPanic(t *testing.T) {
+	c := make(chan os.Signal, 1)
+
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	listenerOpen := false
+	srv := &Server{Server: server, interrupt: c, ShutdownInitiated: func() {
+		calls++
+		if conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port)); err == nil {
+			listenerOpen = true
+			conn.Close()
+		}
+		panic("boom")
+	}}
+	go srv.Serve(l)
+
+	stop := srv.StopChan()
+	time.Sleep(waitTime)
+	c <- os.Interrupt
+	c <- os.Interrupt
+
+	select {
+	case <-stop:
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for server to stop after callback panic")
+	}
+
+	if calls != 1 {
+		t.Fatalf("ShutdownInitiated should be called once, got %d", calls)
+	}
+	if !listenerOpen {
+		t.Fatal("ShutdownInitiated should be called before the listener is closed")
+	}
+}
+
+func hijackingListener(srv *Server) (*http.Server, net.Listener, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		conn, bufrw, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			http.Error(rw, "webserver doesn't support hijacking", http.StatusInternalServerError)
+			return
+		}
+
+		defer conn.Close()
+
+		bufrw.WriteString("HTTP/1.1 200 OK\r\n\r\n")
+		bufrw.Flush()
+	})
+
+	server := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux}
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	return server, l, err
+}
+
+func TestNotifyClosed(t *testing.T) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	c := make(chan os.Signal, 1)
+	srv := &Server{Timeout: killTime, interrupt: c}
+	server, l, err := hijackingListener(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv.Server = server
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		srv.Serve(l)
+	}()
+
+	var once sync.Once
+	for i := 0; i < concurrentRequestN; i++ {
+		wg.Add(1)
+		runQuery(t, http.StatusOK, false, &wg, &once)
+	}
+
+	srv.Stop(0)
+
+	// block on the stopChan until the server has shut down
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for explicit stop to complete")
+	}
+
+	if srv.ActiveConnections() > 0 {
+		t.Fatal("hijacked connections should not be managed")
+	}
+
+}
+
+func TestNoSignalHandling(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// catch the signal ourselves so the test process isn't terminated
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT)
+	defer signal.Stop(sig)
+
+	srv := &Server{Server: server, NoSignalHandling: true}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGINT); err != nil {
+		t.Fatal(err)
+	}
+	<-sig
+
+	select {
+	case <-srv.StopChan():
+		t.Fatal("server should ignore signals when NoSignalHandling is set")
+	case <-time.After(waitTime):
+	}
+
+	srv.Stop(0)
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for explicit stop to complete")
+	}
+}
+
+func TestCustomSignals(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: server, Signals: []os.Signal{syscall.SIGUSR1}}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the custom signal to stop the server")
+	}
+}
+
+func TestImmediateSignals(t *testing.T) {
+	server, l, err := createListener(killTime * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: server, Timeout: killTime * 10,
+		ImmediateSignals: []os.Signal{syscall.SIGUSR2}}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	for i := 0; i < concurrentRequestN; i++ {
+		wg.Add(1)
+		go runQuery(t, 0, true, &wg, &once)
+	}
+	time.Sleep(waitTime)
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-srv.StopChan():
+	case <-time.After(killTime):
+		t.Fatal("Timed out while waiting for the immediate shutdown")
+	}
+	wg.Wait()
+
+	select {
+	case <-srv.TimedOut():
+	default:
+		t.Fatal("TimedOut channel should be closed")
+	}
+}
+
+func TestImmediateSignalsWhileDraining(t *testing.T) {
+	server, l, err := createListener(killTime * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: server, ImmediateSignals: []os.Signal{syscall.SIGUSR2}}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	for i := 0; i < concurrentRequestN; i++ {
+		wg.Add(1)
+		go runQuery(t, 0, true, &wg, &once)
+	}
+	time.Sleep(waitTime)
+
+	srv.Stop(killTime * 10)
+	time.Sleep(waitTime)
+	if !srv.Draining() {
+		t.Fatal("server should be draining")
+	}
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-srv.StopChan():
+	case <-time.After(killTime):
+		t.Fatal("Timed out while waiting for the immediate signal to cut the drain short")
+	}
+	wg.Wait()
+}
+
+func TestInterrupt(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: server, NoSignalHandling: true}
+	srv.Interrupt() <- os.Interrupt
+	go srv.Serve(l)
+
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the interrupt to stop the server")
+	}
+}
+
+func TestTriggerShutdown(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	called := false
+	srv := &Server{Server: server, NoSignalHandling: true,
+		BeforeShutdown: func() bool { called = true; return true }}
+	stop := srv.TriggerShutdown()
+	go srv.Serve(l)
+
+	select {
+	case <-stop:
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for TriggerShutdown to stop the server")
+	}
+	if !called {
+		t.Error("BeforeShutdown should have been called")
+	}
+}
+
+func TestTimeoutOnlyClosesSlowConnections(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(killTime * 10)
+		} else {
+			time.Sleep(killTime / 2)
+		}
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	statsc := make(chan ShutdownStats, 1)
+	srv := &Server{Server: &http.Server{Handler: mux}, NoSignalHandling: true,
+		OnShutdownComplete: func(stats ShutdownStats) { statsc <- stats }}
+
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	for i := 0; i < concurrentRequestN; i++ {
+		wg.Add(1)
+		go runQuery(t, http.StatusOK, false, &wg, &once)
+	}
+	go http.Get(fmt.Sprintf("http://localhost:%d/slow", port))
+	time.Sleep(waitTime)
+
+	err = srv.StopWithResult(killTime)
+	wg.Wait()
+
+	terr, ok := err.(*TimeoutError)
+	if !ok || terr.Conns != 1 {
+		t.Fatalf("expected only the slow connection to be closed, got %#v", err)
+	}
+	if stats := <-statsc; stats.CleanConnections != concurrentRequestN {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestListenerAddr(t *testing.T) {
+	srv := &Server{Server: &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()}, NoSignalHandling: true}
+	if addr := srv.ListenerAddr(); addr != nil {
+		t.Fatalf("expected no address before serving, got %s", addr)
+	}
+
+	go srv.ListenAndServe()
+	defer srv.StopWithResult(killTime)
+	time.Sleep(waitTime)
+
+	addr := srv.ListenerAddr()
+	if addr == nil {
+		t.Fatal("expected the listener address while serving")
+	}
+	if _, port, _ := net.SplitHostPort(addr.String()); port == "0" {
+		t.Fatalf("expected the chosen port, got %s", addr)
+	}
+	r, err := http.Get("http://" + addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+}
+
+func TestSoftTimeout(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: server, SoftTimeout: killTime, HardTimeout: killTime * 4, NoSignalHandling: true}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	client := &http.Client{Transport: &http.Transport{}}
+	get := func() (*http.Response, error) {
+		r, err := client.Get(fmt.Sprintf("http://localhost:%d", port))
+		if err == nil {
+			ioutil.ReadAll(r.Body)
+			r.Body.Close()
+		}
+		return r, err
+	}
+	if _, err := get(); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	result := make(chan error, 1)
+	go func() { result <- srv.StopWithResult(killTime * 4) }()
+	time.Sleep(waitTime)
+
+	// the kept-alive connection is still served during the soft phase
+	r, err := get()
+	if err != nil {
+		t.Fatalf("expected the kept-alive connection to be served, got %s", err)
+	}
+	if r.Close {
+		t.Fatal("keep-alives should not be disabled before the soft timeout")
+	}
+
+	if err := <-result; err != nil {
+		t.Fatalf("expected a clean shutdown, got %s", err)
+	}
+	if elapsed := time.Since(start); elapsed < killTime || elapsed > killTime*3 {
+		t.Fatalf("expected the idle connection to be closed after the soft timeout, took %s", elapsed)
+	}
+}
+
+func TestOnHijackedShutdown(t *testing.T) {
+	notified := make(chan net.Conn, 1)
+	srv := &Server{Timeout: timeoutTime, NoSignalHandling: true,
+		OnHijackedShutdown: func(conn net.Conn) { notified <- conn }}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		conn, bufrw, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			http.Error(rw, "webserver doesn't support hijacking", http.StatusInternalServerError)
+			return
+		}
+		bufrw.WriteString("HTTP/1.1 200 OK\r\n\r\n")
+		bufrw.Flush()
+
+		// hold the connection until asked to close it
+		if c := <-notified; c != conn {
+			t.Error("OnHijackedShutdown called with the wrong connection")
+		}
+		bufrw.WriteString("bye")
+		bufrw.Flush()
+		conn.Close()
+		srv.ReleaseHijacked(conn)
+	})
+	srv.Server = &http.Server{Handler: mux}
+
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	time.Sleep(waitTime)
+
+	if n := srv.ActiveConnections(); n != 1 {
+		t.Fatalf("expected the hijacked connection to be managed, got %d connections", n)
+	}
+
+	if err := srv.StopWithResult(timeoutTime); err != nil {
+		t.Fatalf("expected a clean shutdown, got %s", err)
+	}
+
+	body, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(body), "bye") {
+		t.Fatalf("expected the handler to say bye, got %q", body)
+	}
+}
+
+func TestStopDeadlock(t *testing.T) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	c := make(chan struct{})
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: server, NoSignalHandling: true}
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		time.Sleep(waitTime)
+		srv.Serve(l)
+	}()
+	go func() {
+		defer wg.Done()
+		srv.Stop(0)
+		close(c)
+	}()
+
+	select {
+	case <-c:
+		l.Close()
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for explicit stop to complete")
+	}
+}
+
+func TestConcurrentStop(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: server, NoSignalHandling: true}
+
+	// stopping before serving must not block either
+	srv.Stop(killTime)
+	srv.Stop(killTime)
+
+	go srv.Serve(l)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			srv.Stop(killTime)
+			if err := srv.StopWithResult(killTime); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for concurrent stops to complete")
+	}
+
+	// stopping a stopped server is a no-op
+	srv.Stop(killTime)
+}
+
+// Run with --race
+func TestStopRace(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Timeout: killTime, Server: server}
+
+	go func() {
+		go srv.Serve(l)
+		srv.Stop(killTime)
+	}()
+	srv.Stop(0)
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for explicit stop to complete")
+	}
+}
+
+func TestInterruptLog(t *testing.T) {
+	c := make(chan os.Signal, 1)
+
+	server, l, err := createListener(killTime * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	var tbuf bytes.Buffer
+	logger := log.New(&buf, "", 0)
+	expected := log.New(&tbuf, "", 0)
+
+	srv := &Server{Timeout: killTime, Server: server, Logger: logger, interrupt: c}
+	go func() { srv.Serve(l) }()
+
+	stop := srv.StopChan()
+	c <- os.Interrupt
+	expected.Print("shutdown initiated")
+	expected.Print("draining 0 connection(s)")
+	expected.Print("shutdown complete")
+
+	<-stop
+
+	if buf.String() != tbuf.String() {
+		t.Fatal("shutdown log incorrect - got '" + buf.String() + "'")
+	}
+}
+
+func TestMultiInterrupts(t *testing.T) {
+	c := make(chan os.Signal, 1)
+
+	server, l, err := createListener(killTime * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var bu bytes.Buffer
+	buf := SyncBuffer{&wg, &bu}
+	var tbuf bytes.Buffer
+	logger := log.New(&buf, "", 0)
+	expected := log.New(&tbuf, "", 0)
+
+	srv := &Server{Timeout: killTime, Server: server, Logger: logger, interrupt: c}
+	go func() { srv.Serve(l) }()
+
+	stop := srv.StopChan()
+	buf.Add(1 + 10 + 2) // Expecting 13 log calls
+	c <- os.Interrupt
+	expected.Printf("shutdown initiated")
+	for i := 0; i < 10; i++ {
+		c <- os.Interrupt
+		expected.Printf("already shutting down")
+	}
+	expected.Printf("draining 0 connection(s)")
+	expected.Printf("shutdown complete")
+
+	<-stop
+
+	wg.Wait()
+	// the drain messages may interleave with the repeated interrupts
+	got := strings.Split(buf.String(), "\n")
+	want := strings.Split(tbuf.String(), "\n")
+	sort.Strings(got)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatal(fmt.Sprintf("shutdown log incorrect - got '%s', expected '%s'", buf.String(), tbuf.String()))
+	}
+}
+
+func TestLogFunc(t *testing.T) {
+	c := make(chan os.Signal, 1)
+
+	server, l, err := createListener(killTime * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var called bool
+	srv := &Server{Timeout: killTime, Server: server,
+		LogFunc: func(format string, args ...interface{}) {
 			called = true
 		}, interrupt: c}
 	stop := srv.StopChan()
@@ -675,8 +1816,93 @@ func TestLogFunc(t *testing.T) {
 	c <- os.Interrupt
 	<-stop
 
-	if called != true {
-		t.Fatal("Expected LogFunc to be called.")
+	if called != true {
+		t.Fatal("Expected LogFunc to be called.")
+	}
+}
+
+func TestListenAndServeUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graceful")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "graceful.sock")
+	// a stale socket file should be replaced; a socket closed without a
+	// UnixListener leaves its file behind
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syscall.Bind(fd, &syscall.SockaddrUnix{Name: path})
+	syscall.Close(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(killTime / 2)
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	c := make(chan os.Signal, 1)
+	srv := &Server{Timeout: killTime, interrupt: c,
+		Server: &http.Server{Addr: "unix:" + path, Handler: mux}}
+	go srv.ListenAndServe()
+	time.Sleep(waitTime)
+
+	client := http.Client{Transport: &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		},
+	}}
+
+	errc := make(chan error, 1)
+	go func() {
+		r, err := client.Get("http://unix/")
+		if err == nil && r.StatusCode != http.StatusOK {
+			err = fmt.Errorf("unexpected status code %d", r.StatusCode)
+		}
+		errc <- err
+	}()
+
+	time.Sleep(waitTime)
+	c <- os.Interrupt
+
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for server to stop")
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("socket file should be removed on shutdown")
+	}
+}
+
+func TestListenUnixNotSocket(t *testing.T) {
+	f, err := ioutil.TempFile("", "graceful")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	srv := &Server{Server: &http.Server{Addr: "unix:" + f.Name()}}
+	if err := srv.ListenAndServe(); err == nil {
+		t.Fatal("expected an error listening on a regular file")
+	}
+	if _, err := os.Stat(f.Name()); err != nil {
+		t.Fatal("regular file should not be removed")
 	}
 }
 
@@ -690,3 +1916,483 @@ func (buf *SyncBuffer) Write(b []byte) (int, error) {
 	defer buf.Done()
 	return buf.Buffer.Write(b)
 }
+
+func TestPreflight(t *testing.T) {
+	srv := &Server{Server: &http.Server{Addr: fmt.Sprintf(":%d", port)}}
+	if err := srv.Preflight(); err != nil {
+		t.Fatalf("expected the free port to be bindable, got %v", err)
+	}
+
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	err = srv.Preflight()
+	if be, ok := err.(*BindError); !ok || !be.InUse() {
+		t.Fatalf("expected a BindError for an address in use, got %v", err)
+	}
+	if err := srv.ListenAndServe(); err == nil {
+		t.Fatal("expected ListenAndServe to fail on an address in use")
+	} else if be, ok := err.(*BindError); !ok || !be.InUse() {
+		t.Fatalf("expected a BindError for an address in use, got %v", err)
+	}
+}
+
+func TestBindRetry(t *testing.T) {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The port is freed while the server is still retrying.
+	srv := &Server{Server: &http.Server{Addr: fmt.Sprintf(":%d", port)}, NoSignalHandling: true,
+		BindRetry: 5 * timeoutTime}
+	time.AfterFunc(waitTime*3, func() { l.Close() })
+	go srv.ListenAndServe()
+	select {
+	case <-srv.Ready():
+	case <-time.After(5 * timeoutTime):
+		t.Fatal("expected the server to bind once the port was freed")
+	}
+	srv.StopWithResult(killTime)
+}
+
+func TestBindRetryGivesUp(t *testing.T) {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	srv := &Server{Server: &http.Server{Addr: fmt.Sprintf(":%d", port)}, BindRetry: waitTime * 2}
+	start := time.Now()
+	err = srv.ListenAndServe()
+	if be, ok := err.(*BindError); !ok || !be.InUse() {
+		t.Fatalf("expected a BindError for an address in use, got %v", err)
+	}
+	if d := time.Since(start); d < waitTime*2 {
+		t.Fatalf("expected binding to be retried for %s, gave up after %s", waitTime*2, d)
+	}
+}
+
+func TestOnForceClose(t *testing.T) {
+	server, l, err := createListener(timeoutTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	closed := make(chan error, 10)
+	srv := &Server{Timeout: waitTime, Server: server, NoSignalHandling: true,
+		OnForceClose: func(conn net.Conn) {
+			if conn.RemoteAddr() == nil {
+				t.Error("expected the remote address of the connection")
+			}
+			// This fails once the connection is closed.
+			closed <- conn.SetDeadline(time.Time{})
+		}}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	wg.Add(1)
+	go runQuery(t, http.StatusOK, true, &wg, &once)
+	time.Sleep(waitTime)
+
+	if _, ok := srv.StopWithResult(waitTime).(*TimeoutError); !ok {
+		t.Fatal("expected the connection to be forcefully closed")
+	}
+	wg.Wait()
+	close(closed)
+
+	n := 0
+	for err := range closed {
+		if err != nil {
+			t.Fatalf("expected OnForceClose to be called before the close, got %v", err)
+		}
+		n++
+	}
+	if n != 1 {
+		t.Fatalf("expected OnForceClose to be called once, got %d", n)
+	}
+}
+
+func TestOnForceCloseBlocking(t *testing.T) {
+	server, l, err := createListener(10 * timeoutTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := make(chan struct{})
+	defer close(block)
+	srv := &Server{Timeout: waitTime, Server: server, NoSignalHandling: true,
+		OnForceClose: func(net.Conn) { <-block }}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	wg.Add(1)
+	go runQuery(t, http.StatusOK, true, &wg, &once)
+	time.Sleep(waitTime)
+
+	start := time.Now()
+	srv.StopWithResult(waitTime)
+	if elapsed := time.Since(start); elapsed > forceCloseWait+timeoutTime {
+		t.Fatalf("expected a blocking OnForceClose not to hold up shutdown, took %v", elapsed)
+	}
+	wg.Wait()
+}
+
+func TestTimeoutErrorAddrs(t *testing.T) {
+	server, l, err := createListener(10 * timeoutTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statsc := make(chan ShutdownStats, 1)
+	srv := &Server{Server: server, NoSignalHandling: true,
+		OnShutdownComplete: func(stats ShutdownStats) { statsc <- stats }}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	time.Sleep(waitTime)
+
+	terr, ok := srv.StopWithResult(waitTime).(*TimeoutError)
+	if !ok || len(terr.Addrs) != 1 || terr.Addrs[0].String() != conn.LocalAddr().String() {
+		t.Fatalf("expected the address of the slow client %s, got %#v", conn.LocalAddr(), terr)
+	}
+	if stats := <-statsc; len(stats.ForcedAddrs) != 1 {
+		t.Fatalf("expected the address in the stats, got %+v", stats)
+	}
+}
+
+func TestServeTLSWithRedirect(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+	srv := &Server{Timeout: killTime, NoSignalHandling: true,
+		Server: &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux}}
+	tlsL, err := srv.ListenTLS("test-fixtures/cert.crt", "test-fixtures/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpL, err := net.Listen("tcp", fmt.Sprintf(":%d", port+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ServeTLSWithRedirect(tlsL, httpL) }()
+	time.Sleep(waitTime)
+
+	transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	defer transport.CloseIdleConnections()
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d/path?q=1", port+1), nil)
+	r, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	expected := fmt.Sprintf("https://localhost:%d/path?q=1", port)
+	if r.StatusCode != http.StatusMovedPermanently || r.Header.Get("Location") != expected {
+		t.Fatalf("expected a redirect to %s, got %d %s", expected, r.StatusCode, r.Header.Get("Location"))
+	}
+
+	req, _ = http.NewRequest("GET", expected, nil)
+	r, err = transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d over HTTPS, got %d", http.StatusOK, r.StatusCode)
+	}
+
+	srv.Stop(killTime)
+	if err := <-errc; err != ErrServerClosed {
+		t.Fatalf("expected %v, got %v", ErrServerClosed, err)
+	}
+}
+
+func TestServeTLSWithRedirectProxyProtocol(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(rw, r.RemoteAddr)
+	})
+	srv := &Server{Timeout: killTime, NoSignalHandling: true, ProxyProtocol: true,
+		Server: &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux}}
+	tlsL, err := srv.ListenTLS("test-fixtures/cert.crt", "test-fixtures/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpL, err := net.Listen("tcp", fmt.Sprintf(":%d", port+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeTLSWithRedirect(tlsL, httpL)
+	defer srv.StopWithResult(killTime)
+	<-srv.Ready()
+
+	// The header is read once on each listener, before the TLS handshake.
+	get := func(p int, useTLS bool) *http.Response {
+		conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprint(conn, "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n")
+		if useTLS {
+			conn = tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+		}
+		fmt.Fprint(conn, "GET / HTTP/1.0\r\nHost: localhost\r\n\r\n")
+		r, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	r := get(port+1, false)
+	r.Body.Close()
+	if r.StatusCode != http.StatusMovedPermanently {
+		t.Fatalf("expected a redirect over HTTP, got %d", r.StatusCode)
+	}
+
+	r = get(port, true)
+	body, _ := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if r.StatusCode != http.StatusOK || string(body) != "192.0.2.1:56324" {
+		t.Fatalf("expected 200 from 192.0.2.1:56324 over HTTPS, got %d %q", r.StatusCode, body)
+	}
+}
+
+func TestDrainForever(t *testing.T) {
+	c := make(chan os.Signal, 1)
+
+	server, l, err := createListener(2 * timeoutTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Timeout: waitTime, DrainForever: true, Server: server, interrupt: c}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	wg.Add(1)
+	go runQuery(t, http.StatusOK, false, &wg, &once)
+	time.Sleep(waitTime)
+
+	c <- os.Interrupt
+	select {
+	case <-srv.StopChan():
+		t.Fatal("the server should not stop while a request is running")
+	case <-time.After(timeoutTime):
+	}
+	// A timeout passed to Stop is ignored as well.
+	if err := srv.StopWithResult(waitTime); err != nil {
+		t.Fatalf("expected the request to run to completion, got %v", err)
+	}
+	wg.Wait()
+
+	select {
+	case <-srv.TimedOut():
+		t.Fatal("the timeout should never expire")
+	default:
+	}
+}
+
+func TestTimeoutJitter(t *testing.T) {
+	server, l, err := createListener(10 * timeoutTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := newFakeClock()
+	srv := &Server{Server: server, NoSignalHandling: true, Clock: clock,
+		Timeout: time.Hour, TimeoutJitter: time.Hour, JitterSource: rand.NewSource(1)}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	wg.Add(1)
+	go runQuery(t, http.StatusOK, true, &wg, &once)
+	time.Sleep(waitTime)
+
+	jitter := time.Duration(rand.New(rand.NewSource(1)).Int63n(int64(time.Hour) + 1))
+	srv.Stop(time.Hour)
+	clock.waitFor(t, time.Hour+jitter)
+	clock.Advance(time.Hour + jitter)
+	if _, ok := srv.StopWithResult(0).(*TimeoutError); !ok {
+		t.Fatal("expected the connection to be closed once the jittered timeout expired")
+	}
+	wg.Wait()
+}
+
+func TestScaledTimeout(t *testing.T) {
+	srv := &Server{BaseTimeout: 10 * time.Second, PerConnTimeout: time.Second, MaxTimeout: time.Minute}
+	for _, c := range []struct {
+		conns    int
+		expected time.Duration
+	}{
+		{0, 10 * time.Second},
+		{1, 11 * time.Second},
+		{20, 30 * time.Second},
+		{100, time.Minute},
+	} {
+		if d := srv.scaledTimeout(c.conns); d != c.expected {
+			t.Errorf("expected a timeout of %s for %d connection(s), got %s", c.expected, c.conns, d)
+		}
+	}
+
+	srv.MaxTimeout = 0
+	if d := srv.scaledTimeout(100); d != 110*time.Second {
+		t.Errorf("expected an uncapped timeout of 110s, got %s", d)
+	}
+}
+
+func TestPerConnTimeout(t *testing.T) {
+	server, l, err := createListener(10 * timeoutTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := newFakeClock()
+	srv := &Server{Server: server, NoSignalHandling: true, Clock: clock,
+		Timeout: time.Hour, BaseTimeout: 10 * time.Second, PerConnTimeout: time.Second}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go runQuery(t, http.StatusOK, true, &wg, &once)
+	}
+	time.Sleep(waitTime)
+
+	// Two connections get 12 seconds rather than the hour of the Timeout.
+	srv.TriggerShutdown()
+	clock.waitFor(t, 12*time.Second)
+	clock.Advance(12 * time.Second)
+	if err, ok := srv.StopWithResult(0).(*TimeoutError); !ok || err.Conns != 2 {
+		t.Fatalf("expected both connections to be closed once the scaled timeout expired, got %v", err)
+	}
+	wg.Wait()
+}
+
+// slowWriteListener serves connections whose writes never complete before
+// their write deadline, like clients that stopped reading.
+type slowWriteListener struct {
+	net.Listener
+}
+
+func (l slowWriteListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &slowWriteConn{Conn: conn, closed: make(chan struct{})}, nil
+}
+
+type slowWriteConn struct {
+	net.Conn
+	mu        sync.Mutex
+	deadline  time.Time
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *slowWriteConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *slowWriteConn) Write(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		deadline := c.deadline
+		c.mu.Unlock()
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return 0, errors.New("i/o timeout")
+		}
+		select {
+		case <-c.closed:
+			return 0, io.ErrClosedPipe
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func (c *slowWriteConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func TestConnCloseTimeout(t *testing.T) {
+	server, l, err := createListener(waitTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: server, NoSignalHandling: true, ConnCloseTimeout: waitTime}
+	go srv.Serve(slowWriteListener{l})
+	time.Sleep(waitTime)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(waitTime / 2)
+
+	// Without ConnCloseTimeout, the response would never be sent and the
+	// connection would only be closed once the timeout expired.
+	start := time.Now()
+	if err := srv.StopWithResult(killTime * 4); err != nil {
+		t.Fatalf("expected a clean shutdown, got %s", err)
+	}
+	if d := time.Since(start); d > killTime {
+		t.Fatalf("expected the connection to be closed after %s, took %s", waitTime, d)
+	}
+}
+
+func TestReady(t *testing.T) {
+	srv := &Server{
+		Server:           sleepingServer(fmt.Sprintf(":%d", port), 1*time.Millisecond),
+		NoSignalHandling: true,
+	}
+	ready := srv.Ready()
+	go srv.ListenAndServe()
+
+	select {
+	case <-ready:
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the server to be ready")
+	}
+
+	// No sleep is needed before the first request.
+	r, err := http.Get(fmt.Sprintf("http://localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+
+	srv.Stop(killTime)
+	<-srv.StopChan()
+}
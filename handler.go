@@ -0,0 +1,42 @@
+package graceful
+
+import "net/http"
+
+// SetHandler replaces the handler the server serves requests with, for
+// instance after reloading its configuration. Requests that arrive
+// afterwards are served by h, while those already in flight finish with
+// the previous handler, and no connection is dropped. A nil h means
+// http.DefaultServeMux, as for http.Server. It may be called at any time,
+// including before Serve. The handler is wrapped by the RequestTimeout, if
+// any, like the one set in Handler.
+func (srv *Server) SetHandler(h http.Handler) {
+	if h == nil {
+		h = http.DefaultServeMux
+	}
+	srv.handlerLock.Lock()
+	defer srv.handlerLock.Unlock()
+	srv.handler = h
+}
+
+// installHandler makes the server serve requests with the handler set by
+// SetHandler, or else the one in Handler.
+func (srv *Server) installHandler() {
+	srv.handlerLock.Lock()
+	defer srv.handlerLock.Unlock()
+
+	if srv.handler == nil {
+		srv.handler = srv.Handler
+		if srv.handler == nil {
+			srv.handler = http.DefaultServeMux
+		}
+	}
+	srv.Handler = http.HandlerFunc(srv.serveCurrent)
+}
+
+// serveCurrent serves r with the current handler.
+func (srv *Server) serveCurrent(w http.ResponseWriter, r *http.Request) {
+	srv.handlerLock.RLock()
+	h := srv.handler
+	srv.handlerLock.RUnlock()
+	h.ServeHTTP(w, r)
+}
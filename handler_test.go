@@ -0,0 +1,55 @@
+package graceful
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSetHandler(t *testing.T) {
+	old := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(2 * waitTime)
+		fmt.Fprint(rw, "old")
+	})
+	srv := &Server{Server: &http.Server{Handler: old}, NoSignalHandling: true}
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer srv.StopWithResult(killTime)
+	time.Sleep(waitTime)
+
+	get := func() (string, error) {
+		r, err := http.Get(fmt.Sprintf("http://localhost:%d", port))
+		if err != nil {
+			return "", err
+		}
+		defer r.Body.Close()
+		b, err := ioutil.ReadAll(r.Body)
+		return string(b), err
+	}
+
+	inflight := make(chan string, 1)
+	go func() {
+		body, err := get()
+		if err != nil {
+			t.Error(err)
+		}
+		inflight <- body
+	}()
+	time.Sleep(waitTime)
+
+	srv.SetHandler(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(rw, "new")
+	}))
+	if body, err := get(); err != nil || body != "new" {
+		t.Fatalf("expected new requests to use the new handler, got %q, %v", body, err)
+	}
+	if body := <-inflight; body != "old" {
+		t.Fatalf("expected the in-flight request to finish on the old handler, got %q", body)
+	}
+}
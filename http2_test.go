@@ -122,3 +122,53 @@ func TestHTTP2ListenAndServeTLSConfig(t *testing.T) {
 	go checkIfConnectionToServerIsHTTP2(t, &wg, c)
 	wg.Wait()
 }
+
+func TestHTTP2InFlightRequestCompletes(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(killTime / 2)
+		rw.WriteHeader(http.StatusOK)
+	})
+	server := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux}
+
+	srv := &Server{Timeout: killTime * 4, Server: server, NoSignalHandling: true}
+	go srv.ListenAndServeTLS("test-fixtures/cert.crt", "test-fixtures/key.pem")
+
+	time.Sleep(waitTime) // Wait for the server to start
+
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	if err := http2.ConfigureTransport(tr); err != nil {
+		t.Fatal("Unable to upgrade client transport to HTTP/2")
+	}
+	client := http.Client{Transport: tr}
+
+	type result struct {
+		r   *http.Response
+		err error
+	}
+	rc := make(chan result, 1)
+	go func() {
+		r, err := client.Get(fmt.Sprintf("https://localhost:%d", port))
+		rc <- result{r, err}
+	}()
+
+	time.Sleep(waitTime) // Wait for the request to be in flight
+
+	// the in-flight stream must finish without connections being killed
+	if err := srv.StopWithResult(killTime * 4); err != nil {
+		t.Fatalf("Expected a clean shutdown, got %s", err)
+	}
+
+	res := <-rc
+	if res.err != nil {
+		t.Fatalf("Error encountered while connecting to test server: %s", res.err)
+	}
+	if res.r.Proto != "HTTP/2.0" {
+		t.Fatalf("Expected HTTP/2 connection to server, but connection was using %s", res.r.Proto)
+	}
+	if res.r.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, res.r.StatusCode)
+	}
+}
@@ -13,7 +13,8 @@ type keepAliveConn interface {
 // keepAliveListener sets TCP keep-alive timeouts on accepted
 // connections. It's used by ListenAndServe and ListenAndServeTLS so
 // dead TCP connections (e.g. closing laptop mid-download) eventually
-// go away.
+// go away. Connections that don't support keep-alives, such as Unix
+// domain sockets, are passed through untouched.
 type keepAliveListener struct {
 	net.Listener
 	keepAlivePeriod time.Duration
@@ -25,8 +26,10 @@ func (ln keepAliveListener) Accept() (net.Conn, error) {
 		return nil, err
 	}
 
-	kac := c.(keepAliveConn)
-	kac.SetKeepAlive(true)
-	kac.SetKeepAlivePeriod(ln.keepAlivePeriod)
+	if kac, ok := c.(keepAliveConn); ok {
+		if err := kac.SetKeepAlive(true); err == nil {
+			kac.SetKeepAlivePeriod(ln.keepAlivePeriod)
+		}
+	}
 	return c, nil
 }
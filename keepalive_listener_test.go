@@ -0,0 +1,57 @@
+package graceful
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+type stubListener struct {
+	net.Listener
+	conn net.Conn
+}
+
+func (l stubListener) Accept() (net.Conn, error) { return l.conn, nil }
+
+type keepAliveStubConn struct {
+	net.Conn
+	keepAlive bool
+	period    time.Duration
+}
+
+func (c *keepAliveStubConn) SetKeepAlive(b bool) error {
+	c.keepAlive = b
+	return nil
+}
+
+func (c *keepAliveStubConn) SetKeepAlivePeriod(d time.Duration) error {
+	c.period = d
+	return nil
+}
+
+func TestKeepAliveListenerSetsPeriod(t *testing.T) {
+	conn := &keepAliveStubConn{}
+	ln := keepAliveListener{stubListener{conn: conn}, time.Minute}
+
+	if _, err := ln.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	if !conn.keepAlive || conn.period != time.Minute {
+		t.Fatalf("keep-alive not applied: %v %v", conn.keepAlive, conn.period)
+	}
+}
+
+func TestKeepAliveListenerNonTCP(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	ln := keepAliveListener{stubListener{conn: server}, time.Minute}
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != server {
+		t.Fatal("non-TCP connections should be passed through")
+	}
+}
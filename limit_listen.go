@@ -24,22 +24,48 @@ import (
 // ErrNotTCP indicates that network connection is not a TCP connection.
 var ErrNotTCP = errors.New("only tcp connections have keepalive")
 
+var errListenerClosed = errors.New("listener closed")
+
 // LimitListener returns a Listener that accepts at most n simultaneous
-// connections from the provided Listener.
+// connections from the provided Listener. Once the limit is reached, Accept
+// blocks until a connection is closed or the listener itself is closed.
 func LimitListener(l net.Listener, n int) net.Listener {
-	return &limitListener{l, make(chan struct{}, n)}
+	return &limitListener{
+		Listener: l,
+		sem:      make(chan struct{}, n),
+		done:     make(chan struct{}),
+	}
 }
 
 type limitListener struct {
 	net.Listener
-	sem chan struct{}
+	sem       chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
 }
 
-func (l *limitListener) acquire() { l.sem <- struct{}{} }
+// acquire reports whether a slot was acquired; it returns false if the
+// listener was closed while waiting.
+func (l *limitListener) acquire() bool {
+	select {
+	case <-l.done:
+		return false
+	case l.sem <- struct{}{}:
+		return true
+	}
+}
 func (l *limitListener) release() { <-l.sem }
 
 func (l *limitListener) Accept() (net.Conn, error) {
-	l.acquire()
+	if !l.acquire() {
+		// The listener is closed, so this returns its error immediately.
+		c, err := l.Listener.Accept()
+		if err == nil {
+			c.Close()
+			err = errListenerClosed
+		}
+		return nil, err
+	}
 	c, err := l.Listener.Accept()
 	if err != nil {
 		l.release()
@@ -48,6 +74,14 @@ func (l *limitListener) Accept() (net.Conn, error) {
 	return &limitListenerConn{Conn: c, release: l.release}, nil
 }
 
+// Close closes the underlying listener and wakes up any Accept blocked
+// waiting for a free slot.
+func (l *limitListener) Close() error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() { close(l.done) })
+	return err
+}
+
 type limitListenerConn struct {
 	net.Conn
 	releaseOnce sync.Once
@@ -0,0 +1,91 @@
+package graceful
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLimitListenerQueues(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ll := LimitListener(l, 1)
+	defer ll.Close()
+
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+
+	first, err := ll.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := ll.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- c
+	}()
+
+	select {
+	case <-accepted:
+		t.Fatal("Accept should block while the limit is reached")
+	case <-time.After(waitTime):
+	}
+
+	first.Close()
+
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(timeoutTime):
+		t.Fatal("Accept should resume once a connection is closed")
+	}
+}
+
+func TestLimitListenerCloseReleasesAccept(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ll := LimitListener(l, 1)
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	conn, err := ll.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := ll.Accept()
+		errc <- err
+	}()
+
+	time.Sleep(waitTime)
+	ll.Close()
+
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Fatal("Accept should fail after the listener is closed")
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("Accept blocked after the listener was closed")
+	}
+}
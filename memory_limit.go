@@ -0,0 +1,42 @@
+package graceful
+
+import (
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// defaultMemoryCheckInterval is how often memory use is checked against
+// the MemoryLimitBytes if no MemoryCheckInterval is set.
+const defaultMemoryCheckInterval = 10 * time.Second
+
+// watchMemory triggers shutdown once the memory obtained from the system
+// exceeds the MemoryLimitBytes. It stops watching when done is closed.
+func (srv *Server) watchMemory(done <-chan struct{}) {
+	interval := srv.MemoryCheckInterval
+	if interval <= 0 {
+		interval = defaultMemoryCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var stats runtime.MemStats
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		runtime.ReadMemStats(&stats)
+		if stats.Sys <= srv.MemoryLimitBytes {
+			continue
+		}
+
+		srv.logf("using %d bytes of memory, more than %d, shutting down", stats.Sys, srv.MemoryLimitBytes)
+		select {
+		case srv.interruptChan() <- syscall.SIGTERM:
+		case <-done:
+		}
+		return
+	}
+}
@@ -0,0 +1,43 @@
+package graceful
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryLimit(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Any running program uses more than a byte.
+	srv := &Server{Timeout: killTime, Server: server, NoSignalHandling: true,
+		MemoryLimitBytes: 1, MemoryCheckInterval: waitTime}
+	go srv.Serve(l)
+
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("server should stop once memory use exceeds the limit")
+	}
+	if s := srv.drainStatus(); s.Reason != ReasonSignal {
+		t.Fatalf("expected the shutdown to be reported as a signal, got %q", s.Reason)
+	}
+}
+
+func TestMemoryLimitNotExceeded(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Timeout: killTime, Server: server, NoSignalHandling: true,
+		MemoryLimitBytes: 1 << 62, MemoryCheckInterval: waitTime / 2}
+	go srv.Serve(l)
+
+	select {
+	case <-srv.StopChan():
+		t.Fatal("server should not stop below the limit")
+	case <-time.After(waitTime * 2):
+	}
+	srv.StopWithResult(killTime)
+}
@@ -0,0 +1,107 @@
+package graceful
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryListener is an in-memory net.Listener whose connections are
+// net.Pipe pairs, as used by service mesh data planes and tests.
+type memoryListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newMemoryListener() *memoryListener {
+	return &memoryListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, errors.New("memory listener closed")
+	}
+}
+
+func (l *memoryListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *memoryListener) Addr() net.Addr { return memoryAddr{} }
+
+func (l *memoryListener) Dial(network, addr string) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, errors.New("memory listener closed")
+	}
+}
+
+type memoryAddr struct{}
+
+func (memoryAddr) Network() string { return "memory" }
+func (memoryAddr) String() string  { return "memory" }
+
+func TestMemoryListener(t *testing.T) {
+	l := newMemoryListener()
+	started := make(chan struct{})
+	srv := &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		TCPKeepAlive:     time.Minute,
+		ListenLimit:      10,
+		Server: &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			close(started)
+			time.Sleep(waitTime)
+			rw.WriteHeader(http.StatusOK)
+		})},
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+
+	client := &http.Client{Transport: &http.Transport{Dial: l.Dial}}
+	done := make(chan error, 1)
+	go func() {
+		resp, err := client.Get("http://memory/")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = errors.New(resp.Status)
+			}
+		}
+		done <- err
+	}()
+
+	<-started
+	if n := srv.ActiveConnections(); n != 1 {
+		t.Fatalf("expected 1 active connection, got %d", n)
+	}
+	if _, err := srv.ListenerFile(); err != ErrNoListenerFile {
+		t.Fatalf("expected ErrNoListenerFile, got %v", err)
+	}
+
+	if err := srv.StopWithResult(killTime); err != nil {
+		t.Fatalf("expected a clean shutdown, got %s", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("expected the in-flight request to complete, got %s", err)
+	}
+	select {
+	case <-served:
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for Serve to return")
+	}
+	if _, err := l.Dial("memory", "memory"); err == nil {
+		t.Fatal("expected the listener to be closed")
+	}
+}
@@ -0,0 +1,167 @@
+package graceful
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// drainRetryAfter is the Retry-After, in seconds, of the default response
+// to requests refused by DrainMiddleware when the drain has no deadline.
+const drainRetryAfter = "5"
+
+// retryAfter returns the Retry-After for requests refused while draining:
+// the seconds left until the remaining connections are forcefully closed,
+// rounded up and at least one, or else drainRetryAfter.
+func (srv *Server) retryAfter() string {
+	deadline := srv.drainStatus().Deadline
+	if deadline.IsZero() {
+		return drainRetryAfter
+	}
+	secs := (deadline.Sub(srv.clock().Now()) + time.Second - 1) / time.Second
+	if secs < 1 {
+		secs = 1
+	}
+	return strconv.FormatInt(int64(secs), 10)
+}
+
+// DrainMiddleware wraps next so that requests arriving while the server is
+// draining or paused, such as new requests on kept-alive connections, are
+// refused and the connection is closed. They are answered by DrainResponse,
+// or else with 503 Service Unavailable and a Retry-After header giving
+// the seconds left until the remaining connections are forcefully closed,
+// or five if there is no such deadline, such as while paused. Those sent
+// with Expect: 100-continue are refused without asking the client for
+// their body. Requests that were already being handled when draining
+// started complete normally, and none are refused before the SoftTimeout
+// expires.
+func (srv *Server) DrainMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		draining := srv.Draining() && atomic.LoadInt32(&srv.softPhase) == 0
+		if draining || srv.Paused() {
+			defer srv.skipUnreadBody(r)
+			rw.Header().Set("Connection", "close")
+			if srv.DrainResponse != nil {
+				srv.DrainResponse.ServeHTTP(rw, r)
+				return
+			}
+			rw.Header().Set("Retry-After", srv.retryAfter())
+			http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// skipUnreadBody stops the connection serving r from waiting for a body
+// the client was never asked for. net/http only sends 100 Continue once
+// the handler reads the body, but after the response it still reads a
+// small unread body to reuse the connection, which blocks until the
+// client gives up.
+func (srv *Server) skipUnreadBody(r *http.Request) {
+	if r.ContentLength == 0 || !strings.EqualFold(r.Header.Get("Expect"), "100-continue") {
+		return
+	}
+	if conn, ok := srv.activeConn(r); ok {
+		conn.SetReadDeadline(srv.clock().Now())
+	}
+}
+
+// closeWhenDraining wraps next so that connections are closed after
+// responses written while the server is draining, as they would be with
+// keep-alives disabled.
+func (srv *Server) closeWhenDraining(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if srv.Draining() && atomic.LoadInt32(&srv.softPhase) == 0 {
+			rw.Header().Set("Connection", "close")
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// drainExemptHandler wraps next so that the connections of requests with
+// the DrainExemptHeader are marked with ExtendDeadline.
+func (srv *Server) drainExemptHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(srv.DrainExemptHeader) != "" {
+			srv.ExtendDeadline(r)
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// connCloseHandler wraps next so that, while draining, the connection
+// serving a request has to finish sending its response within the
+// ConnCloseTimeout once next has returned.
+func (srv *Server) connCloseHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(rw, r)
+		if !srv.Draining() {
+			return
+		}
+		if conn, ok := srv.activeConn(r); ok {
+			conn.SetWriteDeadline(time.Now().Add(srv.ConnCloseTimeout))
+		}
+	})
+}
+
+// HostHandler returns a handler that routes requests by their Host to the
+// handler for it in hosts, ignoring the port and case, or else to
+// fallback, which defaults to a 404 Not Found. It is wrapped in
+// DrainMiddleware, so that requests for every host are refused alike while
+// the server drains. hosts is copied, so later changes to it have no
+// effect.
+func (srv *Server) HostHandler(hosts map[string]http.Handler, fallback http.Handler) http.Handler {
+	if fallback == nil {
+		fallback = http.NotFoundHandler()
+	}
+	routes := make(map[string]http.Handler, len(hosts))
+	for host, h := range hosts {
+		routes[strings.ToLower(host)] = h
+	}
+	return srv.DrainMiddleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if h, ok := routes[strings.ToLower(host)]; ok {
+			h.ServeHTTP(rw, r)
+			return
+		}
+		fallback.ServeHTTP(rw, r)
+	}))
+}
+
+// HealthHandler returns a handler for readiness probes, e.g. mounted at
+// /readyz. It responds with 200 OK while the server is running, and with
+// 503 Service Unavailable before it has started and as soon as shutdown is
+// initiated, including during the GraceWindow, so that a load balancer
+// stops routing traffic to the server before it stops accepting it. It also
+// responds with 503 while the server is paused.
+func (srv *Server) HealthHandler() http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if !srv.IsRunning() || atomic.LoadInt32(&srv.shuttingDown) != 0 || srv.Paused() {
+			http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}
+}
+
+// maxBodyHandler limits the request bodies handled by next to n bytes.
+func maxBodyHandler(next http.Handler, n int64) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > n {
+			rw.Header().Set("Connection", "close")
+			http.Error(rw, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if r.Body != nil {
+			r.Body = http.MaxBytesReader(rw, r.Body, n)
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
@@ -0,0 +1,167 @@
+package graceful
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDrainMiddleware(t *testing.T) {
+	srv := &Server{}
+	h := srv.DrainMiddleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, &http.Request{})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected %d before draining, got %d", http.StatusOK, rec.Code)
+	}
+
+	atomic.StoreInt32(&srv.state, stateDraining)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, &http.Request{})
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected %d while draining, got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+	if rec.Header().Get("Connection") != "close" {
+		t.Fatal("expected Connection: close while draining")
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Fatal("expected Retry-After while draining")
+	}
+}
+
+func TestDrainMiddlewareRetryAfter(t *testing.T) {
+	clock := newFakeClock()
+	srv := &Server{Clock: clock}
+	h := srv.DrainMiddleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	atomic.StoreInt32(&srv.state, stateDraining)
+
+	check := func(expected string) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, &http.Request{})
+		if got := rec.Header().Get("Retry-After"); got != expected {
+			t.Fatalf("expected Retry-After %s, got %s", expected, got)
+		}
+	}
+
+	// Without a deadline, such as with DrainForever, a fixed value is used.
+	check(drainRetryAfter)
+
+	srv.stopLock.Lock()
+	srv.deadline = clock.Now().Add(30 * time.Second)
+	srv.stopLock.Unlock()
+	check("30")
+
+	clock.Advance(20*time.Second + time.Millisecond)
+	check("10")
+
+	clock.Advance(time.Minute)
+	check("1")
+}
+
+func TestDrainMiddlewareResponse(t *testing.T) {
+	srv := &Server{DrainResponse: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		rw.Write([]byte(`{"error":"draining"}`))
+	})}
+	h := srv.DrainMiddleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	atomic.StoreInt32(&srv.state, stateDraining)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, &http.Request{})
+	if rec.Code != http.StatusServiceUnavailable || rec.Body.String() != `{"error":"draining"}` {
+		t.Fatalf("expected the DrainResponse, got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Connection") != "close" {
+		t.Fatal("expected Connection: close with a DrainResponse")
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	srv := &Server{}
+	h := srv.HealthHandler()
+	check := func(when string, expected int) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, &http.Request{})
+		if rec.Code != expected {
+			t.Fatalf("expected %d %s, got %d", expected, when, rec.Code)
+		}
+	}
+
+	check("before serving", http.StatusServiceUnavailable)
+	atomic.StoreInt32(&srv.state, stateRunning)
+	check("while running", http.StatusOK)
+	atomic.StoreInt32(&srv.shuttingDown, 1)
+	check("once shutdown is initiated", http.StatusServiceUnavailable)
+	atomic.StoreInt32(&srv.state, stateDraining)
+	check("while draining", http.StatusServiceUnavailable)
+}
+
+func TestMaxBodyHandler(t *testing.T) {
+	h := maxBodyHandler(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}), 4)
+
+	check := func(body string, contentLength int64, expected int) {
+		r, _ := http.NewRequest("POST", "/", strings.NewReader(body))
+		r.ContentLength = contentLength
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != expected {
+			t.Fatalf("expected %d for %q, got %d", expected, body, rec.Code)
+		}
+	}
+
+	check("abcd", 4, http.StatusOK)
+	check("abcdef", 6, http.StatusRequestEntityTooLarge)
+	// Without a Content-Length, the body is cut off while reading.
+	check("abcdef", -1, http.StatusBadRequest)
+}
+
+func TestHostHandler(t *testing.T) {
+	status := func(code int) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.WriteHeader(code)
+		})
+	}
+	srv := &Server{}
+	h := srv.HostHandler(map[string]http.Handler{
+		"api.example.com":   status(http.StatusOK),
+		"Admin.example.com": status(http.StatusAccepted),
+	}, nil)
+
+	check := func(host string, expected int) {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Host = host
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != expected {
+			t.Fatalf("expected %d for %q, got %d", expected, host, rec.Code)
+		}
+	}
+
+	check("api.example.com", http.StatusOK)
+	check("API.example.com:8080", http.StatusOK)
+	check("admin.example.com", http.StatusAccepted)
+	check("other.example.com", http.StatusNotFound)
+
+	atomic.StoreInt32(&srv.state, stateDraining)
+	check("api.example.com", http.StatusServiceUnavailable)
+	check("other.example.com", http.StatusServiceUnavailable)
+}
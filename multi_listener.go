@@ -0,0 +1,100 @@
+package graceful
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+)
+
+// errNoListeners is returned by ServeMulti when it is given no listeners.
+var errNoListeners = errors.New("graceful: no listeners to serve on")
+
+// errorList combines the errors from closing several listeners.
+type errorList []error
+
+func (e errorList) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// multiListener accepts connections from several listeners at once, so
+// that they can be served and shut down as a single listener.
+type multiListener struct {
+	listeners []net.Listener
+	accepted  chan acceptResult
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newMultiListener(listeners []net.Listener) *multiListener {
+	ml := &multiListener{
+		listeners: listeners,
+		accepted:  make(chan acceptResult),
+		done:      make(chan struct{}),
+	}
+	for _, l := range listeners {
+		go ml.acceptLoop(l)
+	}
+	return ml
+}
+
+func (ml *multiListener) acceptLoop(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		select {
+		case ml.accepted <- acceptResult{c, err}:
+		case <-ml.done:
+			if c != nil {
+				c.Close()
+			}
+			return
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+	}
+}
+
+func (ml *multiListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-ml.accepted:
+		return r.conn, r.err
+	case <-ml.done:
+		return nil, errListenerClosed
+	}
+}
+
+// Close closes all of the listeners, returning an errorList if any of
+// them failed to close.
+func (ml *multiListener) Close() error {
+	var errs errorList
+	ml.closeOnce.Do(func() {
+		close(ml.done)
+		for _, l := range ml.listeners {
+			if err := l.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	})
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Addr returns the address of the first listener.
+func (ml *multiListener) Addr() net.Addr {
+	return ml.listeners[0].Addr()
+}
@@ -0,0 +1,148 @@
+package graceful
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Pause stops the server from accepting new connections, without closing
+// the listener, and lets the open connections finish: keep-alives are
+// disabled, so they are closed once their current request is done. New
+// connections wait in the listen backlog until Resume is called. While the
+// server is paused, HealthHandler and DrainMiddleware respond with 503
+// Service Unavailable, so a load balancer can move traffic elsewhere and
+// requests on connections that are kept open can be refused. Unlike Stop,
+// Pause is not permanent.
+//
+// A listener without an accept deadline, such as a TLS listener from
+// ListenTLS or a QUICListener, cannot be interrupted, so the one connection
+// it was accepting when the server is paused is held, untracked, until the
+// server is resumed or stopped.
+func (srv *Server) Pause() {
+	srv.chanLock.Lock()
+	defer srv.chanLock.Unlock()
+
+	if srv.resumed != nil || atomic.LoadInt32(&srv.state) >= stateDraining {
+		return
+	}
+	srv.resumed = make(chan struct{})
+	if srv.Server != nil {
+		srv.SetKeepAlivesEnabled(false)
+	}
+	if srv.pauser != nil {
+		srv.pauser.interrupt()
+	}
+}
+
+// Resume makes a paused server accept connections again.
+func (srv *Server) Resume() {
+	srv.chanLock.Lock()
+	defer srv.chanLock.Unlock()
+
+	if srv.resumed == nil {
+		return
+	}
+	close(srv.resumed)
+	srv.resumed = nil
+	if srv.Server != nil && atomic.LoadInt32(&srv.state) < stateDraining {
+		srv.SetKeepAlivesEnabled(true)
+	}
+}
+
+// Paused reports whether the server has been paused with Pause.
+func (srv *Server) Paused() bool {
+	return srv.pauseChan() != nil
+}
+
+// pauseChan returns a channel that is closed when the server is resumed,
+// or nil if it is not paused.
+func (srv *Server) pauseChan() chan struct{} {
+	srv.chanLock.RLock()
+	defer srv.chanLock.RUnlock()
+	return srv.resumed
+}
+
+// errNoDeadline is returned by listeners wrapping one without an accept
+// deadline.
+var errNoDeadline = errors.New("listener has no deadline")
+
+// deadliner is implemented by listeners whose Accept can be given a
+// deadline, such as *net.TCPListener and *net.UnixListener.
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+// pauseListener stops accepting connections while srv is paused, until it
+// is resumed or the listener is closed. Pause wakes up an Accept that is
+// waiting, by setting a deadline in the past, so that new connections stay
+// in the listen backlog. If the listener has no deadline, the connection
+// accepted after the server is paused is held instead.
+type pauseListener struct {
+	net.Listener
+	srv *Server
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newPauseListener(l net.Listener, srv *Server) *pauseListener {
+	return &pauseListener{Listener: l, srv: srv, done: make(chan struct{})}
+}
+
+func (ln *pauseListener) Accept() (net.Conn, error) {
+	for {
+		if err := ln.wait(); err != nil {
+			return nil, err
+		}
+		c, err := ln.Listener.Accept()
+		// Woken up by Pause: clear the deadline and wait.
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && ln.setDeadline(time.Time{}) == nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		// The server could have been paused while waiting for c.
+		if err := ln.wait(); err != nil {
+			c.Close()
+			return nil, err
+		}
+		return c, nil
+	}
+}
+
+// interrupt wakes up a waiting Accept, if the listener has a deadline.
+func (ln *pauseListener) interrupt() {
+	ln.setDeadline(time.Unix(1, 0))
+}
+
+func (ln *pauseListener) setDeadline(t time.Time) error {
+	d, ok := ln.Listener.(deadliner)
+	if !ok {
+		return errNoDeadline
+	}
+	return d.SetDeadline(t)
+}
+
+// wait blocks while the server is paused.
+func (ln *pauseListener) wait() error {
+	for {
+		resumed := ln.srv.pauseChan()
+		if resumed == nil {
+			return nil
+		}
+		select {
+		case <-resumed:
+		case <-ln.done:
+			return errListenerClosed
+		}
+	}
+}
+
+func (ln *pauseListener) Close() error {
+	ln.closeOnce.Do(func() { close(ln.done) })
+	return ln.Listener.Close()
+}
@@ -0,0 +1,99 @@
+package graceful
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPauseResume(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: server, Timeout: killTime, NoSignalHandling: true}
+	go srv.Serve(l)
+	defer srv.StopWithResult(killTime)
+	time.Sleep(waitTime)
+
+	srv.Pause()
+	if !srv.Paused() {
+		t.Fatal("server should be paused")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		r, err := http.Get(fmt.Sprintf("http://localhost:%d", port))
+		if err == nil {
+			r.Body.Close()
+		}
+		done <- err
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("connections should not be accepted while paused")
+	case <-time.After(waitTime):
+	}
+
+	srv.Resume()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the request after resuming")
+	}
+}
+
+func TestStopWhilePaused(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: server, NoSignalHandling: true}
+	srv.Pause()
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	select {
+	case <-srv.TriggerShutdown():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for a paused server to stop")
+	}
+}
+
+func TestPauseLeavesBacklog(t *testing.T) {
+	l, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Server: &http.Server{Handler: http.NotFoundHandler()}, Timeout: killTime, NoSignalHandling: true}
+	go srv.Serve(l)
+	defer srv.StopWithResult(killTime)
+	<-srv.Ready()
+	time.Sleep(waitTime)
+
+	// The Accept already waiting when the server is paused must not take
+	// the next connection out of the backlog.
+	srv.Pause()
+	time.Sleep(waitTime)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tl := l.(*net.TCPListener)
+	tl.SetDeadline(time.Now().Add(timeoutTime))
+	c, err := tl.Accept()
+	if err != nil {
+		t.Fatalf("expected the connection to wait in the backlog, got %v", err)
+	}
+	c.Close()
+}
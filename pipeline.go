@@ -0,0 +1,60 @@
+package graceful
+
+import (
+	"net"
+	"time"
+)
+
+// pipelineIdleWait is how long a connection that becomes idle while
+// draining with DrainPipelined is kept open, for the server to read the
+// next request if the client had already pipelined one.
+const pipelineIdleWait = 100 * time.Millisecond
+
+// drainPipelined reports whether DrainPipelined applies.
+func (srv *Server) drainPipelined() bool {
+	return srv.DrainPipelined && !srv.UseStdlibShutdown
+}
+
+// closeWhenIdle closes conn once it has stayed idle for pipelineIdleWait.
+func (srv *Server) closeWhenIdle(conn net.Conn) {
+	cancel := make(chan struct{})
+	srv.pipelineLock.Lock()
+	if srv.pipelineIdle == nil {
+		srv.pipelineIdle = map[net.Conn]chan struct{}{}
+	}
+	srv.pipelineIdle[conn] = cancel
+	srv.pipelineLock.Unlock()
+
+	expired := srv.clock().After(pipelineIdleWait)
+	go func() {
+		select {
+		case <-expired:
+		case <-cancel:
+			return
+		}
+
+		srv.pipelineLock.Lock()
+		idle := srv.pipelineIdle[conn] == cancel
+		if idle {
+			delete(srv.pipelineIdle, conn)
+		}
+		srv.pipelineLock.Unlock()
+		if !idle {
+			return
+		}
+		if err := conn.Close(); err != nil {
+			srv.logf("[ERROR] %s", err)
+		}
+	}()
+}
+
+// stopIdleWait cancels the closing of conn by closeWhenIdle, if any.
+func (srv *Server) stopIdleWait(conn net.Conn) {
+	srv.pipelineLock.Lock()
+	defer srv.pipelineLock.Unlock()
+
+	if cancel, ok := srv.pipelineIdle[conn]; ok {
+		close(cancel)
+		delete(srv.pipelineIdle, conn)
+	}
+}
@@ -0,0 +1,116 @@
+package graceful
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+const pipelinedRequest = "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"
+
+func TestDrainPipelined(t *testing.T) {
+	server, l, err := createListener(waitTime * 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: server, NoSignalHandling: true, DrainPipelined: true}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, pipelinedRequest+pipelinedRequest); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(waitTime / 2)
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- srv.StopWithResult(killTime) }()
+
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("reading the first response: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Close {
+		t.Fatalf("expected the first request to complete and keep the connection, got %d close=%v", res.StatusCode, res.Close)
+	}
+
+	res, err = http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("reading the pipelined response: %s", err)
+	}
+	if res.StatusCode != http.StatusServiceUnavailable || !res.Close {
+		t.Fatalf("expected the pipelined request to be refused with Connection: close, got %d close=%v", res.StatusCode, res.Close)
+	}
+	if _, err := ioutil.ReadAll(res.Body); err != nil {
+		t.Fatalf("reading the pipelined response body: %s", err)
+	}
+	res.Body.Close()
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("expected the connection to be closed cleanly, got %v", err)
+	}
+
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatalf("expected a clean shutdown, got %s", err)
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the server to stop")
+	}
+}
+
+func TestDrainPipelinedClosesIdle(t *testing.T) {
+	server, l, err := createListener(waitTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: server, NoSignalHandling: true, DrainPipelined: true}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, pipelinedRequest); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(waitTime / 2)
+
+	start := time.Now()
+	stopped := make(chan error, 1)
+	go func() { stopped <- srv.StopWithResult(killTime * 4) }()
+
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatalf("expected a clean shutdown, got %s", err)
+		}
+		if d := time.Since(start); d > killTime {
+			t.Fatalf("expected the idle connection to be closed promptly, took %s", d)
+		}
+	case <-time.After(timeoutTime * 2):
+		t.Fatal("Timed out while waiting for the server to stop")
+	}
+}
@@ -0,0 +1,94 @@
+package graceful
+
+import (
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// Priority tells how important it is for a request to finish when the
+// server drains. It is set with SetPriority.
+type Priority int
+
+const (
+	// PriorityNormal requests get the Timeout to finish, as requests do
+	// by default.
+	PriorityNormal Priority = iota
+
+	// PriorityLow requests have their connection closed as soon as
+	// draining starts, e.g. analytics pings that are cheap to lose. Their
+	// handlers should return once the request's context is done, since
+	// the drain still waits for them.
+	PriorityLow
+
+	// PriorityHigh requests are kept for the MaxDrainExtension on top of
+	// the Timeout, as with ExtendDeadline, e.g. payments.
+	PriorityHigh
+)
+
+// setPriority marks the connection serving r with p, and closes it right
+// away if p is PriorityLow and the server is draining.
+func (srv *Server) setPriority(r *http.Request, p Priority) bool {
+	if p == PriorityHigh {
+		return srv.ExtendDeadline(r)
+	}
+	conn, ok := srv.activeConn(r)
+	if !ok {
+		return false
+	}
+	srv.unextend(conn)
+
+	srv.priorityLock.Lock()
+	if p == PriorityLow {
+		if srv.lowPriority == nil {
+			srv.lowPriority = map[net.Conn]struct{}{}
+		}
+		srv.lowPriority[conn] = struct{}{}
+	} else {
+		delete(srv.lowPriority, conn)
+	}
+	srv.priorityLock.Unlock()
+
+	if p == PriorityLow && srv.Draining() && atomic.LoadInt32(&srv.softPhase) == 0 {
+		srv.dropLowPriority()
+	}
+	return true
+}
+
+// clearPriority clears the priority set on conn, once its request is done.
+func (srv *Server) clearPriority(conn net.Conn) {
+	srv.priorityLock.Lock()
+	defer srv.priorityLock.Unlock()
+	delete(srv.lowPriority, conn)
+}
+
+// dropLowPriority closes the connections serving PriorityLow requests.
+// They are not counted as drained, nor as forcefully closed.
+func (srv *Server) dropLowPriority() {
+	srv.priorityLock.Lock()
+	conns := make([]net.Conn, 0, len(srv.lowPriority))
+	for conn := range srv.lowPriority {
+		conns = append(conns, conn)
+	}
+	srv.lowPriority = nil
+	srv.priorityLock.Unlock()
+	if len(conns) == 0 {
+		return
+	}
+
+	srv.extendLock.Lock()
+	if srv.cut == nil {
+		srv.cut = map[net.Conn]struct{}{}
+	}
+	for _, conn := range conns {
+		srv.cut[conn] = struct{}{}
+	}
+	srv.extendLock.Unlock()
+
+	srv.logf("closing %d low priority connection(s)", len(conns))
+	for _, conn := range conns {
+		if err := conn.Close(); err != nil {
+			srv.logf("[ERROR] %s", err)
+		}
+	}
+}
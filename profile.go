@@ -0,0 +1,13 @@
+package graceful
+
+import "runtime/pprof"
+
+// profile writes the stacks of all goroutines to ProfileOnTimeout.
+func (srv *Server) profile() {
+	if srv.ProfileOnTimeout == nil {
+		return
+	}
+	if err := pprof.Lookup("goroutine").WriteTo(srv.ProfileOnTimeout, 2); err != nil {
+		srv.logf("[ERROR] writing goroutine profile: %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+package graceful
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout bounds how long a connection may take to send its
+// PROXY protocol header.
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyV2Signature starts every version 2 PROXY protocol header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errBadProxyHeader = errors.New("graceful: invalid PROXY protocol header")
+
+// proxyListener wraps the connections it accepts in proxyConns. It's used
+// when Server.ProxyProtocol is set.
+type proxyListener struct {
+	net.Listener
+}
+
+func (ln proxyListener) Accept() (net.Conn, error) {
+	c, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+// proxyConn reads the version 1 or 2 PROXY protocol header that a load
+// balancer sends ahead of the client's data, and reports the client's
+// address as its RemoteAddr. The header is read on the first call to Read
+// or RemoteAddr, so that Accept does not block on it. Connections without
+// a valid header fail to read.
+type proxyConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	start, err := c.r.Peek(1)
+	if err != nil {
+		c.err = err
+		return
+	}
+	if start[0] == 'P' {
+		c.remote, c.err = readProxyV1(c.r)
+	} else {
+		c.remote, c.err = readProxyV2(c.r)
+	}
+}
+
+// readProxyV1 reads a human-readable header, e.g.
+// "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n". It returns a nil address
+// for UNKNOWN connections.
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	// The longest valid header is 107 bytes.
+	line, err := r.ReadSlice('\n')
+	if err != nil || len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errBadProxyHeader
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errBadProxyHeader
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errBadProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, errBadProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyV2 reads a binary header. It returns a nil address for LOCAL
+// connections, e.g. health checks by the load balancer itself, and for
+// anything but TCP over IPv4 or IPv6.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errBadProxyHeader
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) || header[12]>>4 != 2 {
+		return nil, errBadProxyHeader
+	}
+	command, family := header[12]&0xf, header[13]
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, errBadProxyHeader
+	}
+	if command == 0 {
+		return nil, nil
+	} else if command != 1 {
+		return nil, errBadProxyHeader
+	}
+
+	if family&0xf != 1 {
+		return nil, nil
+	}
+	var ip net.IP
+	var port []byte
+	switch family >> 4 {
+	case 1:
+		if length < 12 {
+			return nil, errBadProxyHeader
+		}
+		ip, port = net.IP(body[0:4]), body[8:10]
+	case 2:
+		if length < 36 {
+			return nil, errBadProxyHeader
+		}
+		ip, port = net.IP(body[0:16]), body[32:34]
+	default:
+		return nil, nil
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(port))}, nil
+}
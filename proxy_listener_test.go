@@ -0,0 +1,91 @@
+package graceful
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestProxyProtocol(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(rw, r.RemoteAddr)
+	})
+	srv := &Server{Server: &http.Server{Handler: mux}, NoSignalHandling: true, ProxyProtocol: true}
+
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer srv.StopWithResult(killTime)
+	time.Sleep(waitTime)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprint(conn, "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n")
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	r, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "192.0.2.1:56324" {
+		t.Fatalf("expected the client address from the PROXY header, got %q", body)
+	}
+}
+
+func TestProxyProtocolV2(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	go func() {
+		header := append([]byte{}, proxyV2Signature...)
+		header = append(header, 0x21, 0x11, 0, 12)
+		header = append(header, 192, 0, 2, 1, 192, 0, 2, 2, 0xdc, 0x04, 0x01, 0xbb)
+		client.Write(append(header, "hello"...))
+	}()
+
+	ln := proxyListener{stubListener{conn: server}}
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := c.RemoteAddr().String(); addr != "192.0.2.1:56324" {
+		t.Fatalf("expected the client address from the PROXY header, got %s", addr)
+	}
+	buf := make([]byte, 5)
+	if _, err := c.Read(buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("expected to read the data after the header, got %q, %v", buf, err)
+	}
+}
+
+func TestProxyProtocolMissingHeader(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	go client.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+
+	ln := proxyListener{stubListener{conn: server}}
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Read(make([]byte, 1)); err != errBadProxyHeader {
+		t.Fatalf("expected %v, got %v", errBadProxyHeader, err)
+	}
+}
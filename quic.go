@@ -0,0 +1,143 @@
+package graceful
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// QUICListener accepts the sessions of a QUIC (HTTP/3) server so that
+// ServeQUIC can drain them on shutdown. graceful does not depend on any QUIC
+// implementation: the caller implements it, usually on top of a quic-go
+// listener, and may use it for any other protocol that net/http does not
+// serve itself.
+type QUICListener interface {
+	// Accept waits for and returns the next session. Once the listener is
+	// closed, it must return an error.
+	Accept() (QUICSession, error)
+
+	// Close stops the listener from accepting sessions. Sessions that
+	// were already accepted must be left open.
+	Close() error
+
+	// Addr returns the listener's network address.
+	Addr() net.Addr
+}
+
+// QUICSession is a session accepted from a QUICListener.
+type QUICSession interface {
+	// Serve serves the requests of the session, and returns once the
+	// session has ended.
+	Serve()
+
+	// Shutdown asks the peer to stop sending new requests, as an HTTP/3
+	// GOAWAY frame does, so that the session ends once the requests in
+	// flight are done. It is called when draining begins, and must not
+	// block.
+	Shutdown()
+
+	// Close closes the session immediately. It is called when the timeout
+	// expires.
+	Close() error
+
+	// RemoteAddr returns the address of the peer.
+	RemoteAddr() net.Addr
+}
+
+// errQUICConn is returned by the net.Conn methods of a QUIC session that
+// have no meaning for it.
+var errQUICConn = errors.New("graceful: not supported on a QUIC session")
+
+// ServeQUIC serves the sessions accepted from l with graceful shutdown,
+// calling Serve on each of them in its own goroutine. It drains them like
+// Serve drains connections: when a signal is received, l is closed, each
+// session is asked to close with Shutdown, and the sessions still open when
+// the timeout expires are closed with Close. The signal handling, timeouts,
+// Pause, the WarmupRate and the callbacks such as ConnState and OnForceClose
+// behave as for Serve; ConnState and ConnTracker see each session as a
+// net.Conn of which only Close, LocalAddr and RemoteAddr work. The options
+// that are specific to TCP or to net/http, such as ListenLimit,
+// TCPKeepAlive, ProxyProtocol, RequestTimeout and UseStdlibShutdown, do not
+// apply.
+//
+// The embedded http.Server is only used for its hooks, and is created if
+// it is nil. To serve HTTP/1 and HTTP/2 next to HTTP/3, use a ServerGroup
+// of two Servers.
+func (srv *Server) ServeQUIC(l QUICListener) error {
+	listener := quicListener{l}
+	if !srv.start(listener) {
+		return ErrAlreadyRunning
+	}
+	if srv.Server == nil {
+		srv.Server = &http.Server{}
+	}
+	// There is no http.Server.Shutdown to wait for the sessions.
+	srv.UseStdlibShutdown = false
+
+	pl := newPauseListener(listener, srv)
+	srv.chanLock.Lock()
+	srv.pauser = pl
+	srv.chanLock.Unlock()
+	wrapped := srv.warmup(newBackoffListener(pl, srv.AcceptBackoffMax, srv.logf))
+	return srv.serve(wrapped, srv.serveQUIC)
+}
+
+// serveQUIC serves the sessions accepted from l until it is closed.
+func (srv *Server) serveQUIC(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		qc := c.(*quicConn)
+		// A session is new and then active for as long as it is served,
+		// as a connection with one long request would be.
+		srv.quicConnState(qc, http.StateNew)
+		srv.quicConnState(qc, http.StateActive)
+		go func() {
+			qc.session.Serve()
+			srv.quicConnState(qc, http.StateClosed)
+		}()
+	}
+}
+
+// quicConnState reports the state of qc through the ConnState hook of the
+// embedded http.Server, which net/http would otherwise call.
+func (srv *Server) quicConnState(qc *quicConn, state http.ConnState) {
+	srv.stopLock.Lock()
+	hook := srv.Server.ConnState
+	srv.stopLock.Unlock()
+	if hook != nil {
+		hook(qc, state)
+	}
+}
+
+// quicListener adapts a QUICListener to a net.Listener, so that sessions
+// are served and drained through the same code as connections.
+type quicListener struct {
+	QUICListener
+}
+
+func (l quicListener) Accept() (net.Conn, error) {
+	s, err := l.QUICListener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &quicConn{session: s, local: l.Addr()}, nil
+}
+
+// quicConn is a QUIC session seen as a net.Conn.
+type quicConn struct {
+	session QUICSession
+	local   net.Addr
+}
+
+func (c *quicConn) Read(b []byte) (int, error)         { return 0, errQUICConn }
+func (c *quicConn) Write(b []byte) (int, error)        { return 0, errQUICConn }
+func (c *quicConn) Close() error                       { return c.session.Close() }
+func (c *quicConn) LocalAddr() net.Addr                { return c.local }
+func (c *quicConn) RemoteAddr() net.Addr               { return c.session.RemoteAddr() }
+func (c *quicConn) SetDeadline(t time.Time) error      { return errQUICConn }
+func (c *quicConn) SetReadDeadline(t time.Time) error  { return errQUICConn }
+func (c *quicConn) SetWriteDeadline(t time.Time) error { return errQUICConn }
@@ -0,0 +1,158 @@
+package graceful
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+type stubQUICListener struct {
+	sessions chan QUICSession
+	done     chan struct{}
+	once     sync.Once
+}
+
+func newStubQUICListener() *stubQUICListener {
+	return &stubQUICListener{sessions: make(chan QUICSession), done: make(chan struct{})}
+}
+
+func (l *stubQUICListener) Accept() (QUICSession, error) {
+	select {
+	case s := <-l.sessions:
+		return s, nil
+	case <-l.done:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *stubQUICListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *stubQUICListener) Addr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+}
+
+// stubQUICSession serves until it is closed, or until it is shut down if
+// it honors Shutdown.
+type stubQUICSession struct {
+	honorShutdown bool
+	shutdown      chan struct{}
+	closed        chan struct{}
+	shutdownOnce  sync.Once
+	closeOnce     sync.Once
+}
+
+func newStubQUICSession(honorShutdown bool) *stubQUICSession {
+	return &stubQUICSession{honorShutdown: honorShutdown,
+		shutdown: make(chan struct{}), closed: make(chan struct{})}
+}
+
+func (s *stubQUICSession) Serve() {
+	if s.honorShutdown {
+		select {
+		case <-s.shutdown:
+			// Finish the request in flight.
+			time.Sleep(waitTime)
+		case <-s.closed:
+		}
+		return
+	}
+	<-s.closed
+}
+
+func (s *stubQUICSession) Shutdown() { s.shutdownOnce.Do(func() { close(s.shutdown) }) }
+
+func (s *stubQUICSession) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	return nil
+}
+
+func (s *stubQUICSession) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4242}
+}
+
+func TestServeQUIC(t *testing.T) {
+	l := newStubQUICListener()
+	srv := &Server{Timeout: killTime, NoSignalHandling: true}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ServeQUIC(l) }()
+
+	s := newStubQUICSession(true)
+	l.sessions <- s
+	time.Sleep(waitTime)
+	if n := srv.ActiveConnections(); n != 1 {
+		t.Fatalf("expected 1 active session, got %d", n)
+	}
+
+	if err := srv.StopWithResult(killTime); err != nil {
+		t.Fatalf("expected a clean shutdown, got %v", err)
+	}
+	select {
+	case <-s.shutdown:
+	default:
+		t.Fatal("expected the session to be shut down")
+	}
+	select {
+	case <-s.closed:
+		t.Fatal("expected the session not to be closed")
+	default:
+	}
+	if err := <-errc; err != ErrServerClosed {
+		t.Fatalf("expected %v, got %v", ErrServerClosed, err)
+	}
+}
+
+func TestServeQUICTimeout(t *testing.T) {
+	l := newStubQUICListener()
+	srv := &Server{Timeout: waitTime, NoSignalHandling: true}
+	go srv.ServeQUIC(l)
+
+	s := newStubQUICSession(false)
+	l.sessions <- s
+	time.Sleep(waitTime)
+
+	err := srv.StopWithResult(waitTime)
+	if err, ok := err.(*TimeoutError); !ok || err.Conns != 1 {
+		t.Fatalf("expected the session to be forcefully closed, got %v", err)
+	}
+	select {
+	case <-s.closed:
+	default:
+		t.Fatal("expected the session to be closed")
+	}
+}
+
+func TestServeQUICStats(t *testing.T) {
+	l := newStubQUICListener()
+	var states []http.ConnState
+	var mu sync.Mutex
+	srv := &Server{Timeout: killTime, NoSignalHandling: true,
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			mu.Lock()
+			states = append(states, state)
+			mu.Unlock()
+		}}
+	go srv.ServeQUIC(l)
+
+	for i := 0; i < 2; i++ {
+		l.sessions <- newStubQUICSession(true)
+	}
+	time.Sleep(waitTime)
+	if stats := srv.Stats(); stats.Served != 2 || stats.Peak != 2 {
+		t.Fatalf("expected 2 sessions served and at peak, got %+v", stats)
+	}
+
+	if err := srv.StopWithResult(killTime); err != nil {
+		t.Fatalf("expected a clean shutdown, got %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(states) == 0 || states[0] != http.StateNew {
+		t.Fatalf("expected sessions to start out new, got %v", states)
+	}
+}
@@ -0,0 +1,110 @@
+package graceful
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// rebindListener accepts connections from a listener that Rebind can
+// replace while it is being served.
+type rebindListener struct {
+	mu     sync.Mutex
+	l      net.Listener
+	gen    int
+	closed bool
+}
+
+func (rl *rebindListener) current() (net.Listener, int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.l, rl.gen
+}
+
+func (rl *rebindListener) Accept() (net.Conn, error) {
+	for {
+		l, gen := rl.current()
+		c, err := l.Accept()
+		if err == nil {
+			return c, nil
+		}
+		// The listener failing because Rebind closed it is not an error;
+		// carry on with the new one.
+		rl.mu.Lock()
+		replaced := rl.gen != gen && !rl.closed
+		rl.mu.Unlock()
+		if !replaced {
+			return nil, err
+		}
+	}
+}
+
+// rebind replaces the listener with l and closes the old one, returning
+// the error from closing it. It closes l and returns errListenerClosed if
+// the listener has been closed already.
+func (rl *rebindListener) rebind(l net.Listener) error {
+	rl.mu.Lock()
+	if rl.closed {
+		rl.mu.Unlock()
+		l.Close()
+		return errListenerClosed
+	}
+	old := rl.l
+	rl.l = l
+	rl.gen++
+	rl.mu.Unlock()
+	return old.Close()
+}
+
+func (rl *rebindListener) Close() error {
+	rl.mu.Lock()
+	rl.closed = true
+	l := rl.l
+	rl.mu.Unlock()
+	return l.Close()
+}
+
+// SetDeadline sets the deadline of the current listener, or returns
+// errNoDeadline if it has none.
+func (rl *rebindListener) SetDeadline(t time.Time) error {
+	l, _ := rl.current()
+	d, ok := l.(deadliner)
+	if !ok {
+		return errNoDeadline
+	}
+	return d.SetDeadline(t)
+}
+
+func (rl *rebindListener) Addr() net.Addr {
+	l, _ := rl.current()
+	return l.Addr()
+}
+
+// Rebind makes the server accept connections from l instead of the
+// listener it is serving on, which is closed, e.g. to move to another
+// address. Connections accepted from either are tracked and drained
+// together, and those already open are not disturbed. If the server is
+// serving TLS, l must be a plain listener and is served with the current
+// TLSConfig, so new connections pick up changes made to it. It returns
+// ErrNotRunning, after closing l, if the server is not serving, or else
+// the error from closing the old listener.
+func (srv *Server) Rebind(l net.Listener) error {
+	srv.chanLock.Lock()
+	rl := srv.rebinder
+	if rl == nil || !srv.IsRunning() {
+		srv.chanLock.Unlock()
+		l.Close()
+		return ErrNotRunning
+	}
+	if _, ok := srv.listener.(tlsListener); ok {
+		l = srv.newTLSListener(l, srv.TLSConfig)
+	}
+	srv.listener = l
+	srv.chanLock.Unlock()
+
+	err := rl.rebind(l)
+	if err == errListenerClosed {
+		return ErrNotRunning
+	}
+	return err
+}
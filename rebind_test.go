@@ -0,0 +1,65 @@
+package graceful
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRebind(t *testing.T) {
+	server, l, err := createListener(killTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Server: server, NoSignalHandling: true}
+
+	if err := srv.Rebind(l); err != ErrNotRunning {
+		t.Fatalf("expected ErrNotRunning before serving, got %v", err)
+	}
+	if l, err = net.Listen("tcp", server.Addr); err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	// A request on the old listener is not disturbed by the rebind.
+	var wg sync.WaitGroup
+	var once sync.Once
+	wg.Add(1)
+	go runQuery(t, http.StatusOK, false, &wg, &once)
+	time.Sleep(waitTime)
+
+	nl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Rebind(nl); err != nil {
+		t.Fatal(err)
+	}
+	if srv.ListenerAddr().String() != nl.Addr().String() {
+		t.Fatalf("expected the listener address to be %s, got %s", nl.Addr(), srv.ListenerAddr())
+	}
+
+	if _, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port)); err == nil {
+		t.Fatal("expected the old listener to be closed")
+	}
+	resp, err := http.Get("http://" + nl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 from the new listener, got %d", resp.StatusCode)
+	}
+
+	wg.Wait()
+	if err := srv.StopWithResult(timeoutTime); err != nil {
+		t.Fatalf("expected a clean shutdown, got %s", err)
+	}
+	if err := srv.Rebind(nl); err != ErrNotRunning {
+		t.Fatalf("expected ErrNotRunning after stopping, got %v", err)
+	}
+}
@@ -0,0 +1,43 @@
+package graceful
+
+import (
+	"net"
+	"net/http"
+)
+
+// ServeTLSWithRedirect serves HTTPS on tlsListener, such as one returned
+// by ListenTLS, and redirects the requests accepted on httpListener to the
+// same URL over HTTPS with 301 Moved Permanently. Both listeners are served
+// as one, as with ServeMulti: a signal shuts them down together and their
+// connections drain within a single Timeout. Errors from either listener
+// are combined into the returned error.
+func (srv *Server) ServeTLSWithRedirect(tlsListener, httpListener net.Listener) error {
+	_, port, err := net.SplitHostPort(tlsListener.Addr().String())
+	if err != nil {
+		tlsListener.Close()
+		httpListener.Close()
+		return err
+	}
+	srv.redirectPort = port
+	return srv.ServeMulti(tlsListener, httpListener)
+}
+
+// redirectHandler serves the requests made over TLS with next, and
+// redirects the others to HTTPS on port.
+func redirectHandler(next http.Handler, port string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(rw, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,62 @@
+package graceful
+
+import (
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// CountingHandler wraps next so that the requests it is handling are
+// counted by InFlightRequests. Unlike the connections counted by
+// ActiveConnections, a kept-alive connection only counts while one of its
+// requests is being handled. With DrainRequests, draining ends once the
+// count drops to zero.
+func (srv *Server) CountingHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&srv.inFlight, 1)
+		defer srv.requestDone()
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// InFlightRequests returns the number of requests being handled by
+// CountingHandler.
+func (srv *Server) InFlightRequests() int {
+	return int(atomic.LoadInt32(&srv.inFlight))
+}
+
+// requestDone records that a request counted by CountingHandler has been
+// handled, and wakes up the drain when it was the last one.
+func (srv *Server) requestDone() {
+	if atomic.AddInt32(&srv.inFlight, -1) != 0 || atomic.LoadInt32(&srv.state) < stateDraining {
+		return
+	}
+	srv.chanLock.RLock()
+	wake := srv.drainWake
+	srv.chanLock.RUnlock()
+
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// closeRemaining closes the connections in tracker once no request is in
+// flight, except the hijacked ones, which are no longer serving requests,
+// and the active ones, which may still be sending the response of a
+// request that has just been handled; trackConn closes those once they
+// are idle.
+func (srv *Server) closeRemaining(tracker ConnTracker) {
+	atomic.StoreInt32(&srv.requestsDrained, 1)
+	var conns []net.Conn
+	tracker.Range(func(conn net.Conn, state http.ConnState) {
+		if state != http.StateHijacked && state != http.StateActive {
+			conns = append(conns, conn)
+		}
+	})
+	for _, conn := range conns {
+		if err := conn.Close(); err != nil {
+			srv.logf("[ERROR] %s", err)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package graceful
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCountingHandler(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	srv := &Server{NoSignalHandling: true, Server: &http.Server{}}
+	srv.Handler = srv.CountingHandler(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	done := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(fmt.Sprintf("http://localhost:%d", port))
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+
+	<-started
+	if n := srv.InFlightRequests(); n != 1 {
+		t.Fatalf("expected 1 request in flight, got %d", n)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.InFlightRequests(); n != 0 {
+		t.Fatalf("expected no request in flight, got %d", n)
+	}
+	srv.StopWithResult(killTime)
+}
+
+func TestDrainRequests(t *testing.T) {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without DrainRequests, the idle connection would hold the drain up
+	// until the timeout.
+	srv := &Server{Server: &http.Server{}, NoSignalHandling: true, NoCloseIdle: true, DrainRequests: true}
+	started := make(chan struct{}, 2)
+	srv.Handler = srv.CountingHandler(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		time.Sleep(waitTime)
+	}))
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	transport := &http.Transport{}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+	resp, err := client.Get(fmt.Sprintf("http://localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(fmt.Sprintf("http://localhost:%d", port))
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+	<-started
+	<-started
+
+	if err := srv.StopWithResult(killTime); err != nil {
+		t.Fatalf("expected a clean shutdown, got %s", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("expected the in-flight request to complete, got %s", err)
+	}
+}
@@ -0,0 +1,300 @@
+package graceful
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// restartFDEnv is the environment variable through which a restarted
+// process learns the file descriptor of the listener it inherited.
+const restartFDEnv = "GRACEFUL_FD"
+
+// restartAddrEnv is the environment variable through which a restarted
+// process learns the address of the listener it inherited, so that only
+// the server listening on that address adopts it.
+const restartAddrEnv = "GRACEFUL_ADDR"
+
+// restartReadyEnv is the environment variable through which a restarted
+// process learns the file descriptor of the pipe on which to tell the
+// parent it is ready.
+const restartReadyEnv = "GRACEFUL_READY_FD"
+
+// restartReadyTimeout bounds how long Restart waits for the new process to
+// be ready.
+const restartReadyTimeout = 30 * time.Second
+
+// ErrNotRestartable is returned by Restart when the listener being served
+// cannot be handed to another process.
+var ErrNotRestartable = errors.New("graceful: listener does not support restart")
+
+// filer is implemented by listeners whose file descriptor can be passed
+// to a child process, such as *net.TCPListener and *net.UnixListener.
+type filer interface {
+	File() (*os.File, error)
+}
+
+// ErrNoListenerFile is returned by ListenerFile when the server is not
+// serving on a listener that has a file descriptor.
+var ErrNoListenerFile = errors.New("graceful: listener has no file descriptor")
+
+// ListenerFile returns a duplicate of the file descriptor of the listener
+// the server is serving on, e.g. to inspect its socket from a monitoring
+// sidecar. The listener stays open; the caller must close the file. It
+// returns ErrNoListenerFile if the server is not serving on a TCP or Unix
+// listener, or one from ListenTLS.
+func (srv *Server) ListenerFile() (*os.File, error) {
+	srv.chanLock.RLock()
+	l := srv.listener
+	srv.chanLock.RUnlock()
+
+	fl, ok := l.(filer)
+	if !ok {
+		return nil, ErrNoListenerFile
+	}
+	return fl.File()
+}
+
+// tlsListener is a TLS listener that exposes the file of the listener it
+// wraps, so that it can be passed to a restarted process.
+type tlsListener struct {
+	net.Listener
+	inner net.Listener
+}
+
+func (l tlsListener) File() (*os.File, error) {
+	f, ok := l.inner.(filer)
+	if !ok {
+		return nil, ErrNoListenerFile
+	}
+	return f.File()
+}
+
+// Restart starts a new copy of the running program, passing it the
+// listener this server is serving on, and then shuts this server down as
+// TriggerShutdown does, with its Timeout, HardTimeout and PerConnTimeout.
+// The new process picks up the listener automatically in the
+// ListenAndServe variant listening on the same address, so no connections
+// are refused while the program is replaced; listeners on other addresses
+// are bound as usual.
+//
+// This server only stops once the new process has called NotifyReady,
+// which Serve does when it starts serving, so that there is always a
+// process accepting connections. If the new process exits before that, or
+// is not ready within restartReadyTimeout, Restart returns an error and
+// this server keeps serving.
+func (srv *Server) Restart() error {
+	srv.chanLock.RLock()
+	l := srv.listener
+	srv.chanLock.RUnlock()
+
+	f, err := srv.ListenerFile()
+	if err == ErrNoListenerFile {
+		return ErrNotRestartable
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+
+	env := make([]string, 0, len(os.Environ())+3)
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, restartFDEnv+"=") && !strings.HasPrefix(e, restartAddrEnv+"=") &&
+			!strings.HasPrefix(e, restartReadyEnv+"=") {
+			env = append(env, e)
+		}
+	}
+	// ExtraFiles start at file descriptor 3 in the child.
+	env = append(env, restartFDEnv+"=3", restartAddrEnv+"="+l.Addr().String(), restartReadyEnv+"=4")
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{f, readyW}
+	err = cmd.Start()
+	// Only the child may hold the write end, so that reading it ends when
+	// the child exits.
+	readyW.Close()
+	if err != nil {
+		return err
+	}
+	srv.logf("restarted as pid %d", cmd.Process.Pid)
+	go cmd.Wait()
+
+	ready := make(chan error, 1)
+	go func() {
+		_, err := readyR.Read(make([]byte, 1))
+		if err == io.EOF {
+			err = fmt.Errorf("graceful: restarted process %d exited before it was ready", cmd.Process.Pid)
+		}
+		ready <- err
+	}()
+	select {
+	case err := <-ready:
+		if err != nil {
+			return err
+		}
+	case <-time.After(restartReadyTimeout):
+		return fmt.Errorf("graceful: restarted process %d not ready after %s", cmd.Process.Pid, restartReadyTimeout)
+	}
+	srv.logf("pid %d is ready", cmd.Process.Pid)
+
+	// The socket file now belongs to the new process as well.
+	if ul, ok := l.(interface {
+		SetUnlinkOnClose(bool)
+	}); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+
+	// Shut down as on SIGTERM, with the configured timeouts.
+	srv.TriggerShutdown()
+	return nil
+}
+
+// handleHangup restarts the server when SIGHUP is received, until the
+// restart succeeds or done is closed.
+func (srv *Server) handleHangup(done chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-hup:
+			if err := srv.Restart(); err != nil {
+				srv.logf("[ERROR] %s", err)
+				continue
+			}
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+// NotifyReady tells the process that started this one with Restart that it
+// is ready to accept connections, so that the parent can stop. Serve calls
+// it when it starts serving, so it only needs to be called directly by
+// programs that hand the inherited listener to something else. It only
+// has an effect once per process, and none if the process was not started
+// by Restart.
+func (srv *Server) NotifyReady() error {
+	readyOnce.Do(func() { readyErr = notifyReady() })
+	return readyErr
+}
+
+var (
+	readyOnce sync.Once
+	readyErr  error
+)
+
+func notifyReady() error {
+	v := os.Getenv(restartReadyEnv)
+	if v == "" {
+		return nil
+	}
+	os.Unsetenv(restartReadyEnv)
+
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("graceful: invalid %s %q", restartReadyEnv, v)
+	}
+	f := os.NewFile(uintptr(fd), "graceful ready")
+	defer f.Close()
+	_, err = f.Write([]byte{1})
+	return err
+}
+
+// inheritLock serializes the servers of a process looking for the
+// listener passed down by Restart.
+var inheritLock sync.Mutex
+
+// inheritedListener returns the listener passed down by Restart if it
+// listens on addr, or nil if there is none or it listens elsewhere. The
+// listener is only handed out once.
+func inheritedListener(addr string) (net.Listener, error) {
+	inheritLock.Lock()
+	defer inheritLock.Unlock()
+
+	v := os.Getenv(restartFDEnv)
+	if v == "" || !inheritsAddr(addr) {
+		return nil, nil
+	}
+	os.Unsetenv(restartFDEnv)
+	os.Unsetenv(restartAddrEnv)
+
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		return nil, fmt.Errorf("graceful: invalid %s %q", restartFDEnv, v)
+	}
+	f := os.NewFile(uintptr(fd), "graceful listener")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// inherits reports whether the process holds a listener passed down by
+// Restart that listens on addr.
+func inherits(addr string) bool {
+	inheritLock.Lock()
+	defer inheritLock.Unlock()
+	return os.Getenv(restartFDEnv) != "" && inheritsAddr(addr)
+}
+
+// inheritsAddr reports whether the listener passed down by Restart listens
+// on addr, as given to listen. A TCP address matches if its port is the
+// same and its host is empty and the listener is on the unspecified
+// address, or its host is or resolves to the listener's IP. An address
+// with port 0 never matches, as it asks for a new port.
+func inheritsAddr(addr string) bool {
+	inherited := os.Getenv(restartAddrEnv)
+	if strings.HasPrefix(addr, unixPrefix) {
+		return inherited == strings.TrimPrefix(addr, unixPrefix)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ihost, iport, err := net.SplitHostPort(inherited)
+	if err != nil {
+		return false
+	}
+	p, err := net.LookupPort("tcp", port)
+	if err != nil || p == 0 || strconv.Itoa(p) != iport {
+		return false
+	}
+
+	ip := net.ParseIP(ihost)
+	if ip == nil {
+		return false
+	}
+	if host == "" {
+		return ip.IsUnspecified()
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return false
+	}
+	for _, hostIP := range ips {
+		if hostIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
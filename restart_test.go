@@ -0,0 +1,300 @@
+package graceful
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestMain turns the test binary into a child server when it is started
+// by Restart, so that the restart can be tested end to end.
+func TestMain(m *testing.M) {
+	if os.Getenv(restartFDEnv) != "" {
+		if os.Getenv(restartFailEnv) != "" {
+			os.Exit(1)
+		}
+		if os.Getenv(restartPairEnv) != "" {
+			runRestartedPair()
+		}
+		runRestartedChild()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// restartFailEnv makes the restarted child exit before it is ready.
+const restartFailEnv = "GRACEFUL_TEST_FAIL"
+
+// restartPairEnv makes the restarted child serve on a second port too.
+const restartPairEnv = "GRACEFUL_TEST_PAIR"
+
+// runRestartedChild serves a single request on the inherited listener.
+func runRestartedChild() {
+	srv := &Server{NoSignalHandling: true}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(rw, "child")
+		go srv.Stop(killTime)
+	})
+	srv.Server = &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux}
+
+	if err := srv.ListenAndServe(); err != ErrServerClosed {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// runRestartedPair serves a single request on port+1 and another on the
+// inherited listener on port, listening on port+1 first.
+func runRestartedPair() {
+	errs := make(chan error, 2)
+	for _, p := range []int{port + 1, port} {
+		listened := make(chan struct{})
+		srv := &Server{NoSignalHandling: true, OnListen: func(net.Addr) { close(listened) }}
+		srv.Server = &http.Server{Addr: fmt.Sprintf(":%d", p), Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(rw, "child")
+			go srv.Stop(killTime)
+		})}
+		go func() { errs <- srv.ListenAndServe() }()
+		select {
+		case <-listened:
+		case err := <-errs:
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != ErrServerClosed {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	os.Exit(0)
+}
+
+func TestInheritedListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// the inherited descriptor is owned by the listener that adopts it
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv(restartFDEnv, strconv.Itoa(fd))
+	defer os.Unsetenv(restartFDEnv)
+	os.Setenv(restartAddrEnv, l.Addr().String())
+	defer os.Unsetenv(restartAddrEnv)
+
+	// a listener on another address is bound as usual
+	srv := &Server{}
+	other, err := srv.listen("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Close()
+	if other.Addr().String() == l.Addr().String() || os.Getenv(restartFDEnv) == "" {
+		t.Fatal("expected the inherited listener to be kept for its own address")
+	}
+
+	inherited, err := srv.listen(l.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inherited.Close()
+
+	if inherited.Addr().String() != l.Addr().String() {
+		t.Fatalf("expected inherited listener on %s, got %s", l.Addr(), inherited.Addr())
+	}
+	if os.Getenv(restartFDEnv) != "" {
+		t.Fatalf("%s should be cleared once the listener is inherited", restartFDEnv)
+	}
+}
+
+func TestRestartNotServing(t *testing.T) {
+	srv := &Server{}
+	if err := srv.Restart(); err != ErrNotRestartable {
+		t.Fatalf("expected ErrNotRestartable, got %v", err)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(rw, "parent")
+	})
+	reason := make(chan string, 1)
+	srv := &Server{HardTimeout: killTime, NoSignalHandling: true,
+		Server: &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux}}
+	srv.ShutdownInitiated = func() { reason <- srv.drainStatus().Reason }
+	go srv.ListenAndServe()
+	time.Sleep(waitTime)
+
+	if err := srv.Restart(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the parent to stop")
+	}
+	// The parent shuts down as on a signal, keeping its HardTimeout.
+	if r := <-reason; r != ReasonSignal {
+		t.Fatalf("expected %q as the reason, got %q", ReasonSignal, r)
+	}
+	if srv.HardTimeout != killTime {
+		t.Fatalf("expected the HardTimeout to be kept, got %s", srv.HardTimeout)
+	}
+
+	// the child keeps serving on the same port
+	var body []byte
+	deadline := time.Now().Add(timeoutTime * 5)
+	for time.Now().Before(deadline) {
+		r, err := http.Get(fmt.Sprintf("http://localhost:%d", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err = ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) == "child" {
+			break
+		}
+		time.Sleep(waitTime)
+	}
+	if string(body) != "child" {
+		t.Fatalf("expected the restarted process to answer, got %q", body)
+	}
+
+	// wait for the child to release the port
+	time.Sleep(timeoutTime)
+}
+
+func TestRestartTwoServers(t *testing.T) {
+	os.Setenv(restartPairEnv, "1")
+	defer os.Unsetenv(restartPairEnv)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(rw, "parent")
+	})
+	srv := &Server{Timeout: killTime, NoSignalHandling: true,
+		Server: &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux}}
+	go srv.ListenAndServe()
+	time.Sleep(waitTime)
+
+	// The child listens on port+1 before port, and must still leave the
+	// inherited listener to the server on port.
+	if err := srv.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the parent to stop")
+	}
+
+	// Without keep-alives, so that no connection to the child of an
+	// earlier test, which has since exited, is reused.
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	for _, p := range []int{port + 1, port} {
+		var body []byte
+		deadline := time.Now().Add(timeoutTime * 5)
+		for time.Now().Before(deadline) {
+			r, err := client.Get(fmt.Sprintf("http://localhost:%d", p))
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ = ioutil.ReadAll(r.Body)
+			r.Body.Close()
+			if string(body) == "child" {
+				break
+			}
+			time.Sleep(waitTime)
+		}
+		if string(body) != "child" {
+			t.Fatalf("expected the restarted process to answer on port %d, got %q", p, body)
+		}
+	}
+
+	// wait for the child to release the ports
+	time.Sleep(timeoutTime)
+}
+
+func TestRestartChildNotReady(t *testing.T) {
+	os.Setenv(restartFailEnv, "1")
+	defer os.Unsetenv(restartFailEnv)
+
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Timeout: killTime, Server: server, NoSignalHandling: true}
+	go srv.Serve(l)
+	defer srv.StopWithResult(killTime)
+	time.Sleep(waitTime)
+
+	if err := srv.Restart(); err == nil {
+		t.Fatal("expected an error when the child exits before it is ready")
+	}
+	if !srv.IsRunning() {
+		t.Fatal("the parent should keep serving")
+	}
+}
+
+func TestListenerFile(t *testing.T) {
+	srv := &Server{}
+	if _, err := srv.ListenerFile(); err != ErrNoListenerFile {
+		t.Fatalf("expected ErrNoListenerFile before serving, got %v", err)
+	}
+
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv = &Server{Timeout: killTime, Server: server, NoSignalHandling: true}
+	go srv.Serve(l)
+	defer srv.StopWithResult(killTime)
+	time.Sleep(waitTime)
+
+	f, err := srv.ListenerFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dup, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dup.Close()
+	if dup.Addr().String() != l.Addr().String() {
+		t.Fatalf("expected the file of the listener on %s, got %s", l.Addr(), dup.Addr())
+	}
+
+	// the server keeps serving after the file is closed
+	r, err := http.Get(fmt.Sprintf("http://localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+}
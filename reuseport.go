@@ -0,0 +1,18 @@
+package graceful
+
+import (
+	"errors"
+	"net"
+)
+
+// ErrReusePortUnsupported is returned when SO_REUSEPORT cannot be set on
+// this platform, or with this version of Go.
+var ErrReusePortUnsupported = errors.New("graceful: SO_REUSEPORT is not supported on this platform")
+
+// ListenReusePort listens on the TCP network and address with SO_REUSEPORT
+// set, so that other processes can listen on the same address and the
+// kernel spreads the connections between them. Pass the listener to Serve;
+// each process then drains its own connections when it shuts down.
+func ListenReusePort(network, addr string) (net.Listener, error) {
+	return listenReusePort(network, addr)
+}
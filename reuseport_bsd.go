@@ -0,0 +1,7 @@
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package graceful
+
+import "syscall"
+
+const soReusePort = syscall.SO_REUSEPORT
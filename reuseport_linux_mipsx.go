@@ -0,0 +1,7 @@
+// +build linux
+// +build mips mipsle mips64 mips64le
+
+package graceful
+
+// soReusePort is SO_REUSEPORT, which differs on MIPS.
+const soReusePort = 0x200
@@ -0,0 +1,9 @@
+// +build !go1.11 !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package graceful
+
+import "net"
+
+func listenReusePort(network, addr string) (net.Listener, error) {
+	return nil, ErrReusePortUnsupported
+}
@@ -0,0 +1,23 @@
+// +build go1.11
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package graceful
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+func listenReusePort(network, addr string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}}
+	return lc.Listen(context.Background(), network, addr)
+}
@@ -0,0 +1,42 @@
+// +build go1.11
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package graceful
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestListenReusePort(t *testing.T) {
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	l1, err := ListenReusePort("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l1.Close()
+	l2, err := ListenReusePort("tcp", addr)
+	if err != nil {
+		t.Fatalf("expected a second listener on the same port, got %v", err)
+	}
+	defer l2.Close()
+}
+
+func TestReusePort(t *testing.T) {
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	l, err := ListenReusePort("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	srv := &Server{Server: &http.Server{Addr: addr}, ReusePort: true}
+	if err := srv.Preflight(); err != nil {
+		t.Fatalf("expected to share the port, got %v", err)
+	}
+	srv.ReusePort = false
+	if err := srv.Preflight(); err == nil {
+		t.Fatal("expected the port to be taken without ReusePort")
+	}
+}
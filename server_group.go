@@ -0,0 +1,172 @@
+package graceful
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ServerGroup runs several servers and shuts them down one after another,
+// in the order they are listed, e.g. so that an admin server serving health
+// checks keeps running until a public server has finished draining, or all
+// at once if Concurrent is set.
+//
+// Example:
+//	group := &graceful.ServerGroup{
+//		Timeout: 10 * time.Second,
+//		Servers: []*graceful.Server{public, admin},
+//	}
+//	group.ListenAndServe()
+type ServerGroup struct {
+	// Servers are the servers in the group, in the order they are stopped.
+	Servers []*Server
+
+	// Timeout is the total duration to allow outstanding requests on all
+	// servers to survive when the group is shut down by a signal. Each
+	// server gets whatever is left of it once the servers before it have
+	// stopped. If Timeout is 0, the servers never time out.
+	Timeout time.Duration
+
+	// Concurrent makes the group stop all of its servers at the same time
+	// rather than in order, each of them with the whole timeout.
+	Concurrent bool
+
+	// Signals lists the signals that shut down the group. If empty, the
+	// group shuts down on SIGINT and SIGTERM.
+	Signals []os.Signal
+
+	// stopLock serializes calls to Stop.
+	stopLock sync.Mutex
+}
+
+// Add adds srv to the group, after the servers already in it. It must be
+// called before ListenAndServe.
+func (g *ServerGroup) Add(srv *Server) {
+	g.Servers = append(g.Servers, srv)
+}
+
+// ListenAndServe calls ListenAndServe on every server in the group and
+// blocks until all of them have stopped. The servers' own signal handling
+// is disabled; instead, a signal shuts down the whole group in order. If
+// one server stops on its own, the others are stopped as well. All errors
+// returned by the servers, other than ErrServerClosed, are combined into
+// the returned error, which is nil if they all stopped cleanly.
+func (g *ServerGroup) ListenAndServe() error {
+	errc := make(chan error, len(g.Servers))
+	for _, srv := range g.Servers {
+		srv.NoSignalHandling = true
+		go func(srv *Server) { errc <- srv.ListenAndServe() }(srv)
+	}
+
+	signals := g.Signals
+	if len(signals) == 0 {
+		signals = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+	}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, signals...)
+	defer signal.Stop(interrupt)
+
+	var errs errorList
+	remaining := len(g.Servers)
+	select {
+	case <-interrupt:
+	case err := <-errc:
+		if err != nil && err != ErrServerClosed {
+			errs = append(errs, err)
+		}
+		remaining--
+	}
+
+	if err := g.Stop(g.Timeout); err != nil {
+		errs = append(errs, err.(errorList)...)
+	}
+	for ; remaining > 0; remaining-- {
+		if err := <-errc; err != nil && err != ErrServerClosed {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Stop stops the servers in the group one after another, waiting for each
+// to finish before stopping the next. timeout is shared by all servers: each
+// server gets whatever is left of it once the servers before it have
+// stopped. With Concurrent, the servers are all stopped at once instead, and
+// Stop returns once every one of them has stopped. If timeout is 0, the
+// servers never time out. The errors returned by StopWithResult are combined
+// into the returned error.
+func (g *ServerGroup) Stop(timeout time.Duration) error {
+	g.stopLock.Lock()
+	defer g.stopLock.Unlock()
+
+	if g.Concurrent {
+		return g.stopConcurrently(timeout)
+	}
+	deadline := time.Now().Add(timeout)
+	var errs errorList
+	for _, srv := range g.Servers {
+		left := time.Duration(0)
+		if timeout > 0 {
+			left = deadline.Sub(time.Now())
+			if left <= 0 {
+				// a zero timeout would wait forever instead
+				left = time.Nanosecond
+			}
+		}
+
+		if err := stopServer(srv, left); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// stopConcurrently stops all of the servers in the group at once with
+// timeout, and waits for them to stop.
+func (g *ServerGroup) stopConcurrently(timeout time.Duration) error {
+	results := make([]error, len(g.Servers))
+	var wg sync.WaitGroup
+	for i, srv := range g.Servers {
+		wg.Add(1)
+		go func(i int, srv *Server) {
+			defer wg.Done()
+			results[i] = stopServer(srv, timeout)
+		}(i, srv)
+	}
+	wg.Wait()
+
+	var errs errorList
+	for _, err := range results {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// stopServer stops srv with timeout, and waits for it to stop if it is
+// serving.
+func stopServer(srv *Server, timeout time.Duration) error {
+	switch {
+	case srv.Stopped():
+	case srv.IsRunning(), srv.Draining():
+		return srv.StopWithResult(timeout)
+	default:
+		// not serving yet; it stops as soon as it starts
+		srv.Stop(timeout)
+	}
+	return nil
+}
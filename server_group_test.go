@@ -0,0 +1,149 @@
+package graceful
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func sleepingServer(addr string, sleep time.Duration) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(sleep)
+		rw.WriteHeader(http.StatusOK)
+	})
+	return &http.Server{Addr: addr, Handler: mux}
+}
+
+func TestServerGroupStopsInOrder(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	stopped := func(name string) func(ShutdownStats) {
+		return func(ShutdownStats) {
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+		}
+	}
+
+	public := sleepingServer(fmt.Sprintf(":%d", port), killTime/2)
+	admin := sleepingServer(fmt.Sprintf(":%d", port+1), 1*time.Millisecond)
+
+	group := &ServerGroup{Servers: []*Server{
+		{Server: public, OnShutdownComplete: stopped("public")},
+		{Server: admin, OnShutdownComplete: stopped("admin")},
+	}}
+
+	errc := make(chan error, 1)
+	go func() { errc <- group.ListenAndServe() }()
+	time.Sleep(waitTime)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	wg.Add(1)
+	go runQuery(t, http.StatusOK, false, &wg, &once)
+	time.Sleep(waitTime)
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGINT); err != nil {
+		t.Fatal(err)
+	}
+
+	// the admin server keeps serving while the public one drains
+	time.Sleep(waitTime)
+	r, err := http.Get(fmt.Sprintf("http://localhost:%d", port+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the group to stop")
+	}
+	wg.Wait()
+
+	if len(order) != 2 || order[0] != "public" || order[1] != "admin" {
+		t.Fatalf("servers stopped in the wrong order: %v", order)
+	}
+}
+
+func TestServerGroupSharesTimeout(t *testing.T) {
+	srvs := []*Server{
+		{Server: sleepingServer(fmt.Sprintf(":%d", port), killTime*10), NoSignalHandling: true},
+		{Server: sleepingServer(fmt.Sprintf(":%d", port+1), killTime*10), NoSignalHandling: true},
+	}
+	for _, srv := range srvs {
+		go srv.ListenAndServe()
+	}
+	time.Sleep(waitTime)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	wg.Add(1)
+	go runQuery(t, 0, true, &wg, &once)
+	time.Sleep(waitTime)
+
+	group := &ServerGroup{Servers: srvs}
+	start := time.Now()
+	err := group.Stop(killTime)
+	wg.Wait()
+
+	if d := time.Since(start); d > killTime+waitTime {
+		t.Fatalf("stopping the group should take about %s, took %s", killTime, d)
+	}
+	errs, ok := err.(errorList)
+	if !ok || len(errs) != 1 {
+		t.Fatalf("expected one timeout error, got %#v", err)
+	}
+	if _, ok := errs[0].(*TimeoutError); !ok {
+		t.Fatalf("expected a *TimeoutError, got %#v", errs[0])
+	}
+}
+
+func TestServerGroupConcurrent(t *testing.T) {
+	group := &ServerGroup{Concurrent: true}
+	group.Add(&Server{Server: sleepingServer(fmt.Sprintf(":%d", port), killTime*10), NoSignalHandling: true})
+	group.Add(&Server{Server: sleepingServer(fmt.Sprintf(":%d", port+1), killTime*10), NoSignalHandling: true})
+	for _, srv := range group.Servers {
+		go srv.ListenAndServe()
+	}
+	time.Sleep(waitTime)
+
+	var wg sync.WaitGroup
+	for _, p := range []int{port, port + 1} {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			if r, err := http.Get(fmt.Sprintf("http://localhost:%d", p)); err == nil {
+				r.Body.Close()
+			}
+		}(p)
+	}
+	time.Sleep(waitTime)
+
+	// Both servers time out at the same time rather than one after the
+	// other.
+	start := time.Now()
+	err := group.Stop(killTime)
+	wg.Wait()
+
+	if d := time.Since(start); d > killTime+waitTime {
+		t.Fatalf("stopping the group should take about %s, took %s", killTime, d)
+	}
+	errs, ok := err.(errorList)
+	if !ok || len(errs) != 2 {
+		t.Fatalf("expected two timeout errors, got %#v", err)
+	}
+	for _, err := range errs {
+		if _, ok := err.(*TimeoutError); !ok {
+			t.Fatalf("expected a *TimeoutError, got %#v", err)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package graceful
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// shutdownFilePoll is how often the ShutdownFile is checked for.
+const shutdownFilePoll = time.Second
+
+// watchShutdownFile triggers shutdown once the ShutdownFile exists, and
+// removes it so that the next start is not shut down right away. It stops
+// watching when done is closed.
+func (srv *Server) watchShutdownFile(done <-chan struct{}) {
+	ticker := time.NewTicker(shutdownFilePoll)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		if _, err := os.Stat(srv.ShutdownFile); err != nil {
+			continue
+		}
+
+		srv.logf("found %s, shutting down", srv.ShutdownFile)
+		if err := os.Remove(srv.ShutdownFile); err != nil {
+			srv.logf("[ERROR] %s", err)
+		}
+		select {
+		case srv.interruptChan() <- syscall.SIGTERM:
+		case <-done:
+		}
+		return
+	}
+}
@@ -0,0 +1,43 @@
+package graceful
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestShutdownFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graceful")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "shutdown")
+
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Timeout: killTime, Server: server, NoSignalHandling: true, ShutdownFile: path}
+	go srv.Serve(l)
+
+	select {
+	case <-srv.StopChan():
+		t.Fatal("server should not stop before the file exists")
+	case <-time.After(shutdownFilePoll + waitTime):
+	}
+
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-srv.StopChan():
+	case <-time.After(shutdownFilePoll + timeoutTime):
+		t.Fatal("server should stop once the file exists")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("the shutdown file should be removed")
+	}
+}
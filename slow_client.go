@@ -0,0 +1,58 @@
+package graceful
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// watchSlowClient closes conn unless the headers of its first request are
+// read within the SlowClientTimeout.
+func (srv *Server) watchSlowClient(conn net.Conn) {
+	srv.readingLock.Lock()
+	defer srv.readingLock.Unlock()
+
+	if srv.reading == nil {
+		srv.reading = map[net.Conn]*time.Timer{}
+	}
+	srv.reading[conn] = time.AfterFunc(srv.SlowClientTimeout, func() {
+		srv.closeSlowClient(conn)
+	})
+}
+
+// stopSlowClient stops watching conn, which has read its first request.
+func (srv *Server) stopSlowClient(conn net.Conn) {
+	srv.readingLock.Lock()
+	defer srv.readingLock.Unlock()
+
+	if timer, ok := srv.reading[conn]; ok {
+		timer.Stop()
+		delete(srv.reading, conn)
+	}
+}
+
+// closeSlowClient closes conn if it is still reading its first request,
+// without counting it as drained.
+func (srv *Server) closeSlowClient(conn net.Conn) {
+	srv.readingLock.Lock()
+	_, ok := srv.reading[conn]
+	delete(srv.reading, conn)
+	srv.readingLock.Unlock()
+	if !ok {
+		return
+	}
+
+	if atomic.LoadInt32(&srv.state) >= stateDraining {
+		srv.extendLock.Lock()
+		if srv.cut == nil {
+			srv.cut = map[net.Conn]struct{}{}
+		}
+		srv.cut[conn] = struct{}{}
+		srv.extendLock.Unlock()
+	}
+
+	srv.logf("closing slow client %s", conn.RemoteAddr())
+	if err := conn.Close(); err != nil {
+		srv.logf("[ERROR] %s", err)
+	}
+}
@@ -0,0 +1,87 @@
+package graceful
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSlowClientTimeout(t *testing.T) {
+	server, l, err := createListener(waitTime * 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: server, NoSignalHandling: true, SlowClientTimeout: waitTime}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A request that takes longer than the timeout to handle is not cut off.
+	done := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(fmt.Sprintf("http://localhost:%d", port))
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(timeoutTime))
+	if b, err := ioutil.ReadAll(conn); err != nil || len(b) > 0 {
+		t.Fatalf("expected the slow client to be closed, got %q %v", b, err)
+	}
+	if d := time.Since(start); d > waitTime*2 {
+		t.Fatalf("expected the slow client to be closed after %s, took %s", waitTime, d)
+	}
+
+	if err := srv.StopWithResult(killTime); err != nil {
+		t.Fatalf("expected a clean shutdown, got %s", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("expected the request to complete, got %s", err)
+	}
+}
+
+func TestSlowClientTimeoutWhileDraining(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: server, NoSignalHandling: true, SlowClientTimeout: waitTime}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(waitTime / 2)
+
+	// The slow client does not hold up shutdown until the timeout.
+	start := time.Now()
+	if err := srv.StopWithResult(killTime * 4); err != nil {
+		t.Fatalf("expected a clean shutdown, got %s", err)
+	}
+	if d := time.Since(start); d > killTime {
+		t.Fatalf("expected the slow client to be closed after %s, took %s", waitTime, d)
+	}
+}
@@ -0,0 +1,50 @@
+package graceful
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// ConnStats counts the connections of a server, as returned by Stats.
+type ConnStats struct {
+	// Served is the number of connections accepted since the server
+	// started serving.
+	Served int64
+
+	// Peak is the largest number of connections that were open at once.
+	Peak int
+
+	// Forced is the number of connections that were forcefully closed by
+	// the shutdown, once it has completed.
+	Forced int
+}
+
+// Stats returns the connection counters of the server. They can be read
+// at any time, e.g. for capacity planning, and are final once the stop
+// channel is closed.
+func (srv *Server) Stats() ConnStats {
+	return ConnStats{
+		Served: atomic.LoadInt64(&srv.served),
+		Peak:   int(atomic.LoadInt32(&srv.peak)),
+		Forced: int(atomic.LoadInt32(&srv.forced)),
+	}
+}
+
+// countConn updates the connection counters for a connection moving to
+// state. A hijacked connection stays open until it is reported closed,
+// either right away or, with OnHijackedShutdown, by ReleaseHijacked.
+func (srv *Server) countConn(state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		atomic.AddInt64(&srv.served, 1)
+		n := atomic.AddInt32(&srv.open, 1)
+		for {
+			peak := atomic.LoadInt32(&srv.peak)
+			if n <= peak || atomic.CompareAndSwapInt32(&srv.peak, peak, n) {
+				return
+			}
+		}
+	case http.StateClosed:
+		atomic.AddInt32(&srv.open, -1)
+	}
+}
@@ -0,0 +1,127 @@
+package graceful
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	started, release := make(chan struct{}, 3), make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	})
+	mux.HandleFunc("/stuck", func(rw http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		time.Sleep(killTime * 2)
+	})
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statsc := make(chan ShutdownStats, 1)
+	srv := &Server{Server: &http.Server{Handler: mux}, NoSignalHandling: true,
+		OnShutdownComplete: func(stats ShutdownStats) { statsc <- stats }}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	get := func(path string, done chan<- struct{}) {
+		resp, err := client.Get(fmt.Sprintf("http://localhost:%d%s", port, path))
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- struct{}{}
+	}
+
+	// Three connections are open at once, and then a fourth on its own.
+	done := make(chan struct{}, 4)
+	for i := 0; i < 3; i++ {
+		go get("/", done)
+		<-started
+	}
+	close(release)
+	for i := 0; i < 3; i++ {
+		<-done
+	}
+	go get("/", done)
+	<-started
+	<-done
+
+	go get("/stuck", done)
+	<-started
+	if s := srv.Stats(); s.Served != 5 || s.Peak != 3 || s.Forced != 0 {
+		t.Fatalf("expected 5 served, a peak of 3 and none forced, got %+v", s)
+	}
+
+	if _, ok := srv.StopWithResult(killTime / 2).(*TimeoutError); !ok {
+		t.Fatal("expected the shutdown to time out")
+	}
+	<-done
+	if s := srv.Stats(); s.Forced != 1 {
+		t.Fatalf("expected 1 forced connection, got %+v", s)
+	}
+	stats := <-statsc
+	if stats.ServedConnections != 5 || stats.PeakConnections != 3 {
+		t.Fatalf("expected the shutdown stats to report 5 served and a peak of 3, got %+v", stats)
+	}
+}
+
+func TestStatsHijacked(t *testing.T) {
+	started, release := make(chan struct{}, 2), make(chan struct{})
+	srv := &Server{NoSignalHandling: true, OnHijackedShutdown: func(net.Conn) {}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hijack", func(rw http.ResponseWriter, r *http.Request) {
+		conn, _, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Close()
+		srv.ReleaseHijacked(conn)
+	})
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	})
+	srv.Server = &http.Server{Handler: mux}
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer srv.StopWithResult(killTime)
+	time.Sleep(waitTime)
+
+	// Each released connection is counted as closed once.
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	for i := 0; i < 3; i++ {
+		if resp, err := client.Get(fmt.Sprintf("http://localhost:%d/hijack", port)); err == nil {
+			resp.Body.Close()
+		}
+	}
+	time.Sleep(waitTime)
+
+	done := make(chan struct{}, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			if resp, err := client.Get(fmt.Sprintf("http://localhost:%d/", port)); err == nil {
+				resp.Body.Close()
+			}
+			done <- struct{}{}
+		}()
+		<-started
+	}
+	if s := srv.Stats(); s.Served != 5 || s.Peak != 2 {
+		t.Fatalf("expected 5 served and a peak of 2, got %+v", s)
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		<-done
+	}
+}
@@ -0,0 +1,66 @@
+package graceful
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+// ErrNotSystemd is returned by ListenSystemd when the process was not
+// started through systemd socket activation.
+var ErrNotSystemd = errors.New("graceful: not started by systemd socket activation")
+
+// ListenSystemd returns the listener passed to the process by systemd
+// socket activation, for use with Serve. It returns ErrNotSystemd if
+// LISTEN_PID and LISTEN_FDS are not set for this process. Only the first
+// socket is used if systemd passed several.
+func ListenSystemd() (net.Listener, error) {
+	return listenSystemd(listenFDsStart)
+}
+
+func listenSystemd(fd uintptr) (net.Listener, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	if pid == "" || fds == "" {
+		return nil, ErrNotSystemd
+	}
+	if pid != strconv.Itoa(os.Getpid()) {
+		return nil, fmt.Errorf("graceful: LISTEN_PID %s does not match pid %d", pid, os.Getpid())
+	}
+	if n, err := strconv.Atoi(fds); err != nil || n < 1 {
+		return nil, fmt.Errorf("graceful: invalid LISTEN_FDS %q", fds)
+	}
+
+	// Child processes must not inherit the sockets again.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+
+	f := os.NewFile(fd, "systemd listener")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// sdNotify sends state to the NOTIFY_SOCKET, if it is set.
+func (srv *Server) sdNotify(state string) {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return
+	}
+	// A leading @ stands for an abstract socket.
+	if name[0] == '@' {
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		srv.logf("[ERROR] sd_notify: %s", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		srv.logf("[ERROR] sd_notify: %s", err)
+	}
+}
@@ -0,0 +1,109 @@
+package graceful
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestListenSystemdNotActivated(t *testing.T) {
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+
+	if _, err := ListenSystemd(); err != ErrNotSystemd {
+		t.Fatalf("expected ErrNotSystemd, got %v", err)
+	}
+}
+
+func TestListenSystemdWrongPid(t *testing.T) {
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+
+	if _, err := ListenSystemd(); err == nil || err == ErrNotSystemd {
+		t.Fatalf("expected a pid mismatch error, got %v", err)
+	}
+}
+
+func TestListenSystemd(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// listenSystemd takes ownership of the descriptor it is given
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "1")
+
+	sl, err := listenSystemd(uintptr(fd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sl.Close()
+
+	if sl.Addr().String() != l.Addr().String() {
+		t.Fatalf("expected listener on %s, got %s", l.Addr(), sl.Addr())
+	}
+	if os.Getenv("LISTEN_PID") != "" || os.Getenv("LISTEN_FDS") != "" {
+		t.Fatal("systemd environment should be cleared")
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graceful")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "notify")
+	sock, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	os.Setenv("NOTIFY_SOCKET", name)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	expect := func(state string) {
+		sock.SetReadDeadline(time.Now().Add(timeoutTime))
+		buf := make([]byte, 64)
+		n, err := sock.Read(buf)
+		if err != nil {
+			t.Fatalf("expected %s, got %s", state, err)
+		}
+		if string(buf[:n]) != state {
+			t.Fatalf("expected %s, got %q", state, buf[:n])
+		}
+	}
+
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Server: server, NoSignalHandling: true, SdNotify: true}
+	go srv.Serve(l)
+	expect("READY=1")
+
+	srv.Stop(killTime)
+	expect("STOPPING=1")
+	<-srv.StopChan()
+}
@@ -0,0 +1,92 @@
+package graceful
+
+import "sync"
+
+// Track runs fn and blocks until it returns. While it runs, shutdown waits
+// for it as for an open connection, up to the same Timeout. It can be used
+// to protect work that must not be interrupted, e.g. from a request handler
+// that has already written its response.
+func (srv *Server) Track(fn func()) {
+	srv.tasks.add()
+	defer srv.tasks.done()
+	fn()
+}
+
+// Go is like Track, but runs fn in a new goroutine and returns immediately.
+// It can be used to start background jobs that shutdown waits for.
+func (srv *Server) Go(fn func()) {
+	srv.tasks.add()
+	go func() {
+		defer srv.tasks.done()
+		fn()
+	}()
+}
+
+// startDrainWaiters runs the DrainWaiters as tasks, until the returned
+// channel is closed.
+func (srv *Server) startDrainWaiters() chan struct{} {
+	srv.stopLock.Lock()
+	waiters := srv.drainWaiters
+	srv.stopLock.Unlock()
+
+	stop := make(chan struct{})
+	for _, wait := range waiters {
+		srv.tasks.add()
+		go func(wait func(<-chan struct{}) error) {
+			defer srv.tasks.done()
+			if err := wait(stop); err != nil {
+				srv.logf("[ERROR] %s", err)
+			}
+		}(wait)
+	}
+	return stop
+}
+
+// taskGroup counts the tasks started with Track and Go. Unlike a
+// sync.WaitGroup, it may be waited on while tasks are being added.
+type taskGroup struct {
+	mu sync.Mutex
+	n  int
+	// idle is closed once n drops back to zero.
+	idle chan struct{}
+}
+
+func (g *taskGroup) add() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.n == 0 {
+		g.idle = make(chan struct{})
+	}
+	g.n++
+}
+
+func (g *taskGroup) done() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.n--
+	if g.n == 0 {
+		close(g.idle)
+	}
+}
+
+// wait returns a channel that is closed when no tasks are running.
+func (g *taskGroup) wait() <-chan struct{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.n == 0 {
+		idle := make(chan struct{})
+		close(idle)
+		return idle
+	}
+	return g.idle
+}
+
+// count returns the number of tasks running.
+func (g *taskGroup) count() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.n
+}
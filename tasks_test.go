@@ -0,0 +1,57 @@
+package graceful
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGo(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: server, Timeout: killTime, NoSignalHandling: true}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	finished := make(chan struct{})
+	srv.Go(func() {
+		time.Sleep(killTime / 2)
+		close(finished)
+	})
+
+	if err := srv.StopWithResult(killTime); err != nil {
+		t.Fatalf("expected a clean shutdown, got %s", err)
+	}
+	select {
+	case <-finished:
+	default:
+		t.Fatal("shutdown should wait for the task to finish")
+	}
+}
+
+func TestGoTimesOut(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: server, NoSignalHandling: true}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	release := make(chan struct{})
+	defer close(release)
+	srv.Go(func() { <-release })
+
+	start := time.Now()
+	err = srv.StopWithResult(killTime)
+	if time.Since(start) < killTime {
+		t.Fatal("shutdown should wait for the task until the timeout expires")
+	}
+	terr, ok := err.(*TimeoutError)
+	if !ok || terr.Tasks != 1 {
+		t.Fatalf("expected a *TimeoutError with 1 task, got %#v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package graceful
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// NewTestServer starts serving handler with a Server on a local
+// httptest.Server, so that tests can stop it with Stop, Shutdown or
+// TriggerShutdown and check how their handlers behave while draining.
+// The Server does not handle signals. The httptest.Server is started, so
+// its URL and Client are set up as usual, but the connections are served
+// by the Server. Closing the httptest.Server stops the Server gracefully
+// using its Timeout, and returns once it has stopped. It only serves plain
+// HTTP.
+func NewTestServer(handler http.Handler) (*Server, *httptest.Server) {
+	ts := httptest.NewUnstartedServer(handler)
+	srv := &Server{Server: ts.Config, NoSignalHandling: true}
+	l := ts.Listener
+	tl := &testListener{Listener: l, srv: srv, accepting: make(chan struct{}), done: make(chan struct{})}
+	ts.Listener = tl
+
+	// Start sets up the URL and the Client. The Server only starts once the
+	// httptest.Server is done setting up ts.Config, and then replaces its
+	// ConnState hook, on which the Close of the httptest.Server would wait
+	// while the connections drain.
+	ts.Start()
+	<-tl.accepting
+	go srv.Serve(l)
+	<-srv.Ready()
+	return srv, ts
+}
+
+// testListener is the listener of an httptest.Server started by
+// NewTestServer. It reports the address of the listener the Server is
+// serving on, but hands no connections to the httptest.Server. Closing it,
+// as httptest.Server.Close does, stops the Server gracefully.
+type testListener struct {
+	net.Listener
+	srv *Server
+
+	accepting  chan struct{}
+	acceptOnce sync.Once
+	closeOnce  sync.Once
+	done       chan struct{}
+}
+
+func (l *testListener) Accept() (net.Conn, error) {
+	l.acceptOnce.Do(func() { close(l.accepting) })
+	<-l.done
+	return nil, errListenerClosed
+}
+
+func (l *testListener) Close() error {
+	defer l.closeOnce.Do(func() { close(l.done) })
+
+	// The Server closes the listener itself once it is draining.
+	if !l.srv.IsRunning() {
+		return l.Listener.Close()
+	}
+	l.srv.stopLock.Lock()
+	timeout := l.srv.Timeout
+	l.srv.stopLock.Unlock()
+	l.srv.StopWithResult(timeout)
+	return nil
+}
@@ -0,0 +1,59 @@
+package graceful
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNewTestServer(t *testing.T) {
+	started := make(chan struct{})
+	draining := make(chan bool, 1)
+	var srv *Server
+	srv, ts := NewTestServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(waitTime)
+		draining <- srv.Draining()
+	}))
+	srv.Timeout = timeoutTime
+
+	errc := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(ts.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		errc <- err
+	}()
+	<-started
+
+	// Closing the httptest.Server drains the request in flight.
+	ts.Close()
+	select {
+	case <-srv.StopChan():
+	default:
+		t.Fatal("expected the server to have stopped once Close returned")
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("expected the request to complete, got %s", err)
+	}
+	if !<-draining {
+		t.Fatal("expected the handler to see the server draining")
+	}
+}
+
+func TestNewTestServerClient(t *testing.T) {
+	_, ts := NewTestServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("hello"))
+	}))
+	defer ts.Close()
+
+	resp, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+}
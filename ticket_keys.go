@@ -0,0 +1,33 @@
+// +build go1.5
+
+package graceful
+
+import "errors"
+
+// ErrNoTLSConfig is returned by SetTLSTicketKeys when the server is not
+// serving TLS.
+var ErrNoTLSConfig = errors.New("graceful: server has no TLS config")
+
+// SetTLSTicketKeys replaces the keys used to encrypt and decrypt TLS
+// session tickets while the server is serving, with the first one used for
+// new tickets, e.g. to rotate them periodically for forward secrecy
+// without a restart. The keys are set on the config the TLS listener
+// serves, which with ListenTLS and ServeTLS is a copy of the TLSConfig.
+// It is safe to call during
+// handshakes, which use either the old keys or the new ones. It must be
+// called after the server has started listening with ListenTLS, ServeTLS
+// or one of their variants, and does not affect configs returned by
+// GetConfigForClient.
+func (srv *Server) SetTLSTicketKeys(keys [][32]byte) error {
+	if len(keys) == 0 {
+		return errors.New("graceful: no session ticket keys")
+	}
+	srv.chanLock.RLock()
+	config := srv.servedTLS
+	srv.chanLock.RUnlock()
+	if config == nil {
+		return ErrNoTLSConfig
+	}
+	config.SetSessionTicketKeys(keys)
+	return nil
+}
@@ -0,0 +1,125 @@
+// +build go1.5
+
+package graceful
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSetTLSTicketKeys(t *testing.T) {
+	srv := &Server{Timeout: killTime, NoSignalHandling: true, Server: &http.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: http.NotFoundHandler(),
+	}}
+	if err := srv.SetTLSTicketKeys([][32]byte{{1}}); err != ErrNoTLSConfig {
+		t.Fatalf("expected ErrNoTLSConfig before listening, got %v", err)
+	}
+
+	l, err := srv.ListenTLS("test-fixtures/cert.crt", "test-fixtures/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer func() {
+		srv.Stop(0)
+		<-srv.StopChan()
+	}()
+	select {
+	case <-srv.Ready():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the server to be ready")
+	}
+
+	// The client does not resume sessions whose certificate has expired,
+	// as the test certificate has.
+	config := &tls.Config{
+		Time:               func() time.Time { return time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC) },
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	}
+	resumed := func() bool {
+		conn, err := tls.Dial("tcp", fmt.Sprintf("localhost:%d", port), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().DidResume
+	}
+
+	if err := srv.SetTLSTicketKeys([][32]byte{{1}}); err != nil {
+		t.Fatal(err)
+	}
+	resumed()
+	if !resumed() {
+		t.Fatal("expected the session to be resumed")
+	}
+
+	// Tickets issued with the old key can no longer be decrypted.
+	if err := srv.SetTLSTicketKeys([][32]byte{{2}}); err != nil {
+		t.Fatal(err)
+	}
+	if resumed() {
+		t.Fatal("expected the session not to be resumed after rotating the key")
+	}
+
+	// Keeping the previous key lets its tickets be resumed.
+	if err := srv.SetTLSTicketKeys([][32]byte{{3}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+	if !resumed() {
+		t.Fatal("expected the session to be resumed with the previous key")
+	}
+}
+
+func TestSetTLSTicketKeysWhileServing(t *testing.T) {
+	srv := &Server{Timeout: killTime, NoSignalHandling: true, Server: &http.Server{
+		Handler: http.NotFoundHandler(),
+	}}
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The keys are rotated while ServeTLS sets up its config and while
+	// clients handshake.
+	done := make(chan struct{})
+	rotated := make(chan struct{})
+	go func() {
+		defer close(rotated)
+		for i := byte(0); ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			srv.SetTLSTicketKeys([][32]byte{{i}})
+		}
+	}()
+	go srv.ServeTLS(l, "test-fixtures/cert.crt", "test-fixtures/key.pem")
+	defer func() {
+		srv.Stop(0)
+		<-srv.StopChan()
+	}()
+	<-srv.Ready()
+
+	config := &tls.Config{InsecureSkipVerify: true, ClientSessionCache: tls.NewLRUClientSessionCache(1)}
+	for i := 0; i < 5; i++ {
+		conn, err := tls.Dial("tcp", fmt.Sprintf("localhost:%d", port), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	close(done)
+	<-rotated
+
+	if err := srv.SetTLSTicketKeys([][32]byte{{1}}); err != nil {
+		t.Fatalf("expected the served config to take the keys, got %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package graceful
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// defaultTunnelGrace is the TunnelGrace used if none is set.
+const defaultTunnelGrace = time.Second
+
+// Tunnel copies data between client, typically a connection hijacked by
+// the handler of a CONNECT request, and upstream, the connection to the
+// destination, in both directions. It blocks until either end closes, or
+// until the TunnelGrace has expired once draining begins, and then closes
+// both. Shutdown waits for the tunnel like a task started with Track, so a
+// tunnel is torn down after the TunnelGrace without holding up shutdown
+// for the whole Timeout, whether or not OnHijackedShutdown is set.
+func (srv *Server) Tunnel(client, upstream net.Conn) {
+	srv.Track(func() {
+		done := make(chan struct{}, 2)
+		pipe := func(dst, src net.Conn) {
+			io.Copy(dst, src)
+			done <- struct{}{}
+		}
+		go pipe(upstream, client)
+		go pipe(client, upstream)
+
+		grace := srv.TunnelGrace
+		if grace <= 0 {
+			grace = defaultTunnelGrace
+		}
+		finished := 0
+		select {
+		case <-done:
+			finished++
+		case <-srv.drainStarted():
+			select {
+			case <-done:
+				finished++
+			case <-srv.clock().After(grace):
+			}
+		}
+
+		client.Close()
+		upstream.Close()
+		for ; finished < 2; finished++ {
+			<-done
+		}
+	})
+}
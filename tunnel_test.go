@@ -0,0 +1,99 @@
+package graceful
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTunnel(t *testing.T) {
+	// The upstream echoes what it receives, and reports when its end of
+	// the tunnel is closed.
+	ul, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ul.Close()
+	upstreamClosed := make(chan struct{})
+	go func() {
+		conn, err := ul.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+		conn.Close()
+		close(upstreamClosed)
+	}()
+
+	srv := &Server{Timeout: 10 * timeoutTime, TunnelGrace: waitTime, NoSignalHandling: true}
+	srv.Server = &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" {
+			http.Error(rw, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadGateway)
+			return
+		}
+		conn, bufrw, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		bufrw.WriteString("HTTP/1.1 200 Connection established\r\n\r\n")
+		bufrw.Flush()
+		srv.Tunnel(conn, upstream)
+	})}
+
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", ul.Addr(), ul.Addr())
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the tunnel to be established, got %d", resp.StatusCode)
+	}
+
+	fmt.Fprint(conn, "ping")
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(br, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("expected the tunnel to carry data, got %q, %v", buf, err)
+	}
+
+	// Both ends are closed once the grace has expired, well before the
+	// Timeout, and the shutdown is clean.
+	start := time.Now()
+	if err := srv.StopWithResult(10 * timeoutTime); err != nil {
+		t.Fatalf("expected a clean shutdown, got %s", err)
+	}
+	if d := time.Since(start); d > timeoutTime {
+		t.Fatalf("expected the tunnel to be closed after the grace, took %s", d)
+	}
+	conn.SetReadDeadline(time.Now().Add(timeoutTime))
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Fatalf("expected the client end to be closed, got %v", err)
+	}
+	select {
+	case <-upstreamClosed:
+	case <-time.After(timeoutTime):
+		t.Fatal("expected the upstream end to be closed")
+	}
+}
@@ -0,0 +1,73 @@
+package graceful
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// warmupListener accepts at most rate connections per second until the
+// warmup ends, so that a herd of reconnecting clients does not hit cold
+// caches all at once. The limit is lifted as soon as shutdown starts, and
+// closing the listener interrupts the wait.
+type warmupListener struct {
+	net.Listener
+	srv   *Server
+	every time.Duration
+	until time.Time
+
+	// last is the time of the last accept. Accept is only called from one
+	// goroutine at a time.
+	last time.Time
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newWarmupListener(l net.Listener, srv *Server, rate int, d time.Duration) *warmupListener {
+	return &warmupListener{
+		Listener: l,
+		srv:      srv,
+		every:    time.Second / time.Duration(rate),
+		until:    time.Now().Add(d),
+		done:     make(chan struct{}),
+	}
+}
+
+func (ln *warmupListener) Accept() (net.Conn, error) {
+	if err := ln.wait(); err != nil {
+		return nil, err
+	}
+	c, err := ln.Listener.Accept()
+	if err == nil {
+		ln.last = time.Now()
+	}
+	return c, err
+}
+
+// wait blocks until the next connection may be accepted.
+func (ln *warmupListener) wait() error {
+	if ln.last.IsZero() || atomic.LoadInt32(&ln.srv.shuttingDown) != 0 {
+		return nil
+	}
+	now := time.Now()
+	next := ln.last.Add(ln.every)
+	if !now.Before(ln.until) || !now.Before(next) {
+		return nil
+	}
+
+	timer := time.NewTimer(next.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ln.done:
+		return errListenerClosed
+	}
+}
+
+func (ln *warmupListener) Close() error {
+	ln.closeOnce.Do(func() { close(ln.done) })
+	return ln.Listener.Close()
+}
@@ -0,0 +1,73 @@
+package graceful
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWarmupListener(t *testing.T) {
+	conn, client := net.Pipe()
+	defer conn.Close()
+	defer client.Close()
+
+	ln := newWarmupListener(&failingListener{conn: conn}, &Server{}, 10, time.Minute)
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		if _, err := ln.Accept(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Fatalf("expected accepts 100ms apart during the warmup, took %s", elapsed)
+	}
+}
+
+func TestWarmupListenerEnds(t *testing.T) {
+	conn, client := net.Pipe()
+	defer conn.Close()
+	defer client.Close()
+
+	ln := newWarmupListener(&failingListener{conn: conn}, &Server{}, 1, waitTime)
+	time.Sleep(waitTime)
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		if _, err := ln.Accept(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > waitTime {
+		t.Fatalf("expected no limit after the warmup, took %s", elapsed)
+	}
+}
+
+func TestWarmupListenerShutdown(t *testing.T) {
+	conn, client := net.Pipe()
+	defer conn.Close()
+	defer client.Close()
+
+	srv := &Server{}
+	ln := newWarmupListener(&failingListener{conn: conn}, srv, 1, time.Minute)
+	if _, err := ln.Accept(); err != nil {
+		t.Fatal(err)
+	}
+
+	atomic.StoreInt32(&srv.shuttingDown, 1)
+	start := time.Now()
+	if _, err := ln.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > waitTime {
+		t.Fatalf("expected no limit once shutdown has started, took %s", elapsed)
+	}
+
+	atomic.StoreInt32(&srv.shuttingDown, 0)
+	go func() {
+		time.Sleep(waitTime)
+		ln.Close()
+	}()
+	if _, err := ln.Accept(); err != errListenerClosed {
+		t.Fatalf("expected closing to interrupt the wait, got %v", err)
+	}
+}
@@ -0,0 +1,48 @@
+package graceful
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// workerHandler lets at most MaxWorkers requests be handled by next at
+// once, with at most QueueSize more waiting for their turn. Requests beyond
+// that are refused with 503 Service Unavailable, and so are those still
+// waiting when draining starts. A waiting request whose client goes away
+// gives up its place.
+func (srv *Server) workerHandler(next http.Handler) http.Handler {
+	slots := make(chan struct{}, srv.MaxWorkers)
+	queue := int32(srv.QueueSize)
+	var waiting int32
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		select {
+		case slots <- struct{}{}:
+		default:
+			if atomic.AddInt32(&waiting, 1) > queue {
+				atomic.AddInt32(&waiting, -1)
+				rw.Header().Set("Retry-After", drainRetryAfter)
+				http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			}
+			gone, closed := requestGone(rw, r)
+			select {
+			case slots <- struct{}{}:
+				atomic.AddInt32(&waiting, -1)
+			case <-srv.drainStarted():
+				atomic.AddInt32(&waiting, -1)
+				rw.Header().Set("Connection", "close")
+				rw.Header().Set("Retry-After", srv.retryAfter())
+				http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			case <-gone:
+				atomic.AddInt32(&waiting, -1)
+				return
+			case <-closed:
+				atomic.AddInt32(&waiting, -1)
+				return
+			}
+		}
+		defer func() { <-slots }()
+		next.ServeHTTP(rw, r)
+	})
+}
@@ -0,0 +1,160 @@
+package graceful
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMaxWorkers(t *testing.T) {
+	release := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		<-release
+		rw.WriteHeader(http.StatusOK)
+	})
+	server := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux}
+	l, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: server, NoSignalHandling: true, MaxWorkers: 1, QueueSize: 1}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	// The first request is handled and the second waits for it.
+	codes := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			resp, err := http.Get(fmt.Sprintf("http://localhost:%d", port))
+			if err != nil {
+				codes <- 0
+				return
+			}
+			resp.Body.Close()
+			codes <- resp.StatusCode
+		}()
+		time.Sleep(waitTime)
+	}
+
+	// The queue is full, so the third is refused.
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 with the queue full, got %d", resp.StatusCode)
+	}
+
+	// Draining refuses the waiting request, and finishes the running one.
+	result := make(chan error, 1)
+	go func() { result <- srv.StopWithResult(timeoutTime) }()
+	if code := <-codes; code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 for the queued request once draining, got %d", code)
+	}
+	close(release)
+	if code := <-codes; code != http.StatusOK {
+		t.Fatalf("expected 200 for the handled request, got %d", code)
+	}
+	if err := <-result; err != nil {
+		t.Fatalf("expected a clean shutdown, got %s", err)
+	}
+}
+
+func TestMaxWorkersClientGone(t *testing.T) {
+	release := make(chan struct{})
+	handled := make(chan struct{}, 2)
+	srv := &Server{NoSignalHandling: true, MaxWorkers: 1, QueueSize: 1}
+	srv.Server = &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		handled <- struct{}{}
+		<-release
+	})}
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer srv.StopWithResult(timeoutTime)
+	time.Sleep(waitTime)
+
+	go http.Get(fmt.Sprintf("http://localhost:%d", port))
+	<-handled
+
+	// A queued client that leaves frees its place for another.
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	time.Sleep(waitTime)
+	conn.Close()
+	time.Sleep(waitTime)
+
+	go http.Get(fmt.Sprintf("http://localhost:%d", port))
+	close(release)
+	for i := 0; i < 1; i++ {
+		select {
+		case <-handled:
+		case <-time.After(timeoutTime):
+			t.Fatal("expected the next queued request to be handled")
+		}
+	}
+	select {
+	case <-handled:
+		t.Fatal("expected the request of the client that left not to be handled")
+	case <-time.After(waitTime):
+	}
+}
+
+func TestMaxWorkersRequestTimeout(t *testing.T) {
+	var active, peak int32
+	srv := &Server{NoSignalHandling: true, MaxWorkers: 1, QueueSize: 1, RequestTimeout: waitTime}
+	srv.Server = &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&active, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(3 * waitTime)
+		atomic.AddInt32(&active, -1)
+	})}
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer srv.StopWithResult(timeoutTime)
+	<-srv.Ready()
+
+	// The handler of the first request keeps running after it has timed
+	// out, and holds its worker until then.
+	codes := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			r, err := http.Get(fmt.Sprintf("http://localhost:%d", port))
+			if err != nil {
+				codes <- 0
+				return
+			}
+			r.Body.Close()
+			codes <- r.StatusCode
+		}()
+		time.Sleep(waitTime * 3 / 2)
+	}
+	for i := 0; i < 2; i++ {
+		if code := <-codes; code != http.StatusServiceUnavailable {
+			t.Fatalf("expected both requests to time out, got %d", code)
+		}
+	}
+	time.Sleep(3 * waitTime)
+	if p := atomic.LoadInt32(&peak); p != 1 {
+		t.Fatalf("expected at most one handler at once, got %d", p)
+	}
+}